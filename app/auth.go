@@ -0,0 +1,234 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Credentials are applied only to requests to the host
+// they were configured for
+type Credentials struct {
+	Username string // basic auth
+	Password string
+	Token    string            // bearer token
+	Headers  map[string]string // custom headers, e.g. X-Api-Key
+}
+
+// WithCredentials adds credentials for the host.
+// host may include port, e.g. "docs.example.com:8443".
+func WithCredentials(host string, c Credentials) Option {
+	return func(d *Downloader) {
+		d.credentials[strings.ToLower(host)] = c
+	}
+}
+
+// WithCookieJar makes Downloader send and store cookies using jar
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(d *Downloader) {
+		d.client.Jar = jar
+	}
+}
+
+// ParseCredentials parses credentials spec in one of the forms:
+//
+//	host=basic:user:password
+//	host=bearer:token
+//	host=header:Name:value
+//
+// and returns host with its credentials.
+func ParseCredentials(spec string) (string, Credentials, error) {
+	c := Credentials{}
+
+	eq := strings.Index(spec, "=")
+	if eq <= 0 {
+		return "", c, errors.New("credentials should be in form host=kind:value")
+	}
+	host := spec[:eq]
+
+	parts := strings.SplitN(spec[eq+1:], ":", 3)
+	switch {
+	case parts[0] == "basic" && len(parts) == 3:
+		c.Username = parts[1]
+		c.Password = parts[2]
+	case parts[0] == "bearer" && len(parts) >= 2:
+		c.Token = strings.Join(parts[1:], ":")
+	case parts[0] == "header" && len(parts) == 3:
+		c.Headers = map[string]string{parts[1]: strings.TrimSpace(parts[2])}
+	default:
+		return "", c, fmt.Errorf("invalid credentials for %s", host)
+	}
+
+	return host, c, nil
+}
+
+// MergeCredentials combines two credentials sets, values of b win
+func MergeCredentials(a, b Credentials) Credentials {
+	if b.Username != "" || b.Password != "" {
+		a.Username = b.Username
+		a.Password = b.Password
+	}
+	if b.Token != "" {
+		a.Token = b.Token
+	}
+
+	headers := make(map[string]string, len(a.Headers)+len(b.Headers))
+	for k, v := range a.Headers {
+		headers[k] = v
+	}
+	for k, v := range b.Headers {
+		headers[k] = v
+	}
+	a.Headers = headers
+
+	return a
+}
+
+// credentialsFor returns credentials configured for u's host
+func (d *Downloader) credentialsFor(u *url.URL) (Credentials, bool) {
+	c, ok := d.credentials[strings.ToLower(u.Host)]
+	if ok {
+		return c, true
+	}
+
+	c, ok = d.credentials[strings.ToLower(u.Hostname())]
+	return c, ok
+}
+
+// applyCredentials sets auth headers of the request's host
+func (d *Downloader) applyCredentials(req *http.Request) {
+	c, ok := d.credentialsFor(req.URL)
+	if !ok {
+		return
+	}
+
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// removeCredentials removes auth headers which could be set
+// by applyCredentials for any host
+func (d *Downloader) removeCredentials(req *http.Request) {
+	req.Header.Del("Authorization")
+	for _, c := range d.credentials {
+		for k := range c.Headers {
+			req.Header.Del(k)
+		}
+	}
+}
+
+// checkRedirect makes sure credentials and headers of one host
+// are not sent to another one after redirect
+func (d *Downloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if req.URL.Host != via[len(via)-1].URL.Host {
+		d.removeCredentials(req)
+		d.removeHostHeaders(req)
+		d.applyHeaders(req)
+		d.applyCredentials(req)
+	}
+
+	return nil
+}
+
+// LoadCookieJar creates cookie jar pre-loaded
+// with cookies from Netscape cookies.txt file
+func LoadCookieJar(filename string) (http.CookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == "" {
+		return jar, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer closeC(f)
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		u, cookie, err := parseCookieLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		cookie.HttpOnly = httpOnly
+
+		jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+
+	return jar, scanner.Err()
+}
+
+// parseCookieLine parses one line of cookies.txt:
+// domain, include subdomains, path, secure, expires, name, value
+func parseCookieLine(line string) (*url.URL, *http.Cookie, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 7 {
+		return nil, nil, errors.New("invalid number of fields")
+	}
+
+	domain := fields[0]
+	host := strings.TrimPrefix(domain, ".")
+	secure := strings.EqualFold(fields[3], "TRUE")
+
+	expires, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid expiration: %v", err)
+	}
+
+	cookie := &http.Cookie{
+		Name:   fields[5],
+		Value:  fields[6],
+		Path:   fields[2],
+		Secure: secure,
+	}
+	if strings.EqualFold(fields[1], "TRUE") {
+		// otherwise it's host-only cookie
+		cookie.Domain = host
+	}
+	if expires > 0 {
+		cookie.Expires = time.Unix(expires, 0)
+	}
+
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+
+	return &url.URL{Scheme: scheme, Host: host, Path: fields[2]}, cookie, nil
+}
@@ -0,0 +1,457 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetMode defines what is done with charsets of pages and files
+type CharsetMode string
+
+const (
+	// CharsetIgnore stores files as they are fetched and parses
+	// pages as UTF-8
+	CharsetIgnore CharsetMode = "ignore"
+	// CharsetDetect records detected charset of pages and files,
+	// files are stored as they are fetched, pages are decoded for parsing
+	CharsetDetect CharsetMode = "detect"
+	// CharsetUTF8 is CharsetDetect which also transcodes files to UTF-8
+	CharsetUTF8 CharsetMode = "utf8"
+)
+
+// ParseCharsetMode parses mode name
+func ParseCharsetMode(s string) (CharsetMode, error) {
+	switch m := CharsetMode(s); m {
+	case CharsetIgnore, CharsetDetect, CharsetUTF8:
+		return m, nil
+	}
+
+	return "", errors.New("charset mode should be one of: ignore, detect, utf8")
+}
+
+// WithCharset sets how charsets of pages and files are handled
+func WithCharset(mode CharsetMode) Option {
+	return func(d *Downloader) {
+		d.charset = mode
+	}
+}
+
+// charsetSniffLen is how many bytes are used to detect charset,
+// html spec looks for meta in the first 1024 bytes
+const charsetSniffLen = 4096
+
+// charset names used in records
+const (
+	charsetUTF8    = "utf-8"
+	charsetUTF16LE = "utf-16le"
+	charsetUTF16BE = "utf-16be"
+	charsetLatin1  = "iso-8859-1"
+	charset1252    = "windows-1252"
+	charset1251    = "windows-1251"
+	charsetKOI8R   = "koi8-r"
+	charsetSJIS    = "shift_jis"
+)
+
+// charsetAliases maps common labels to charset names
+var charsetAliases = map[string]string{
+	"utf8":              charsetUTF8,
+	"unicode-1-1-utf-8": charsetUTF8,
+	"utf-16":            charsetUTF16LE,
+	"ucs-2":             charsetUTF16LE,
+	"latin1":            charsetLatin1,
+	"iso8859-1":         charsetLatin1,
+	"iso_8859-1":        charsetLatin1,
+	"l1":                charsetLatin1,
+	"us-ascii":          charset1252, // as browsers do
+	"ascii":             charset1252,
+	"cp1252":            charset1252,
+	"x-cp1252":          charset1252,
+	"cp1251":            charset1251,
+	"x-cp1251":          charset1251,
+	"koi8":              charsetKOI8R,
+	"koi":               charsetKOI8R,
+	"cskoi8r":           charsetKOI8R,
+	"sjis":              charsetSJIS,
+	"shift-jis":         charsetSJIS,
+	"ms_kanji":          charsetSJIS,
+	"x-sjis":            charsetSJIS,
+	"windows-31j":       charsetSJIS,
+	"cp932":             charsetSJIS,
+}
+
+func normalizeCharset(label string) string {
+	name := strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if alias, ok := charsetAliases[name]; ok {
+		return alias
+	}
+
+	return name
+}
+
+var boms = []struct {
+	bom     []byte
+	charset string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, charsetUTF8},
+	{[]byte{0xff, 0xfe}, charsetUTF16LE},
+	{[]byte{0xfe, 0xff}, charsetUTF16BE},
+}
+
+var (
+	xmlEncoding = regexp.MustCompile(`^<\?xml[^>]*\sencoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+	metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([A-Za-z0-9._:-]+)`)
+)
+
+// detectCharset returns charset of text by its BOM, Content-Type,
+// xml declaration, meta tag of html pages or by its bytes,
+// and the length of BOM
+func detectCharset(contentType string, head []byte, html bool) (string, int) {
+	for _, b := range boms {
+		if bytes.HasPrefix(head, b.bom) {
+			return b.charset, len(b.bom)
+		}
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err == nil && params["charset"] != "" {
+		return normalizeCharset(params["charset"]), 0
+	}
+
+	if m := xmlEncoding.FindSubmatch(head); m != nil {
+		return normalizeCharset(string(m[1])), 0
+	}
+	if html {
+		prescan := head
+		if len(prescan) > 1024 {
+			prescan = prescan[:1024]
+		}
+		if m := metaCharset.FindSubmatch(prescan); m != nil {
+			return normalizeCharset(string(m[1])), 0
+		}
+	}
+
+	return sniffCharset(head), 0
+}
+
+// sniffCharset guesses charset of text without any declarations.
+// Only UTF-8, UTF-16, Shift_JIS, windows-1251, KOI8-R
+// and windows-1252 are told apart.
+func sniffCharset(head []byte) string {
+	// ascii text in UTF-16 has zero every second byte,
+	// which is valid UTF-8 too
+	var evenZeros, oddZeros int
+	for i, b := range head {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	if oddZeros > len(head)/8 && evenZeros <= oddZeros/8 {
+		return charsetUTF16LE
+	}
+	if evenZeros > len(head)/8 && oddZeros <= evenZeros/8 {
+		return charsetUTF16BE
+	}
+
+	if validUTF8Prefix(head) {
+		return charsetUTF8
+	}
+
+	if validShiftJIS(head) {
+		return charsetSJIS
+	}
+
+	// Russian text is mostly lowercase letters, which are
+	// 0xe0-0xff in windows-1251 and 0xc0-0xdf in KOI8-R
+	var high, upper, lower int
+	for _, b := range head {
+		switch {
+		case b >= 0xe0:
+			upper++
+		case b >= 0xc0:
+			lower++
+		}
+		if b >= 0x80 {
+			high++
+		}
+	}
+	if upper+lower > high*3/4 && upper+lower > 0 {
+		if upper >= lower {
+			return charset1251
+		}
+		return charsetKOI8R
+	}
+
+	return charset1252
+}
+
+// validUTF8Prefix is utf8.Valid which allows text
+// to be cut in the middle of the last character
+func validUTF8Prefix(p []byte) bool {
+	if utf8.Valid(p) {
+		return true
+	}
+
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			return !utf8.FullRune(p[len(p)-i:]) && utf8.Valid(p[:len(p)-i])
+		}
+	}
+
+	return false
+}
+
+// validShiftJIS checks that text is Shift_JIS with double-byte
+// characters. Half-width katakana is rare, text where it's
+// more common than double-byte characters is likely KOI8-R.
+func validShiftJIS(p []byte) bool {
+	var pairs, kana int
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch {
+		case b < 0x80:
+		case b >= 0xa1 && b <= 0xdf:
+			kana++
+		case (b >= 0x81 && b <= 0x9f) || (b >= 0xe0 && b <= 0xfc):
+			if i+1 == len(p) {
+				// cut in the middle of the character
+				break
+			}
+			t := p[i+1]
+			if t < 0x40 || t == 0x7f || t > 0xfc {
+				return false
+			}
+			pairs++
+			i++
+		default:
+			return false
+		}
+	}
+
+	return pairs > kana
+}
+
+// decoder converts src to UTF-8 appending it to dst,
+// it returns number of bytes of src used. With eof
+// incomplete characters at the end are replaced too.
+type decoder func(dst, src []byte, eof bool) ([]byte, int)
+
+// decoders of charsets which can be transcoded to UTF-8
+var decoders = map[string]decoder{
+	charsetLatin1:  decodeLatin1,
+	charset1252:    singleByteDecoder(&windows1252),
+	charset1251:    singleByteDecoder(&windows1251),
+	charsetKOI8R:   singleByteDecoder(&koi8r),
+	charsetUTF16LE: utf16Decoder(false),
+	charsetUTF16BE: utf16Decoder(true),
+	charsetSJIS:    decodeShiftJIS,
+}
+
+func decodeLatin1(dst, src []byte, eof bool) ([]byte, int) {
+	for _, b := range src {
+		if b < utf8.RuneSelf {
+			dst = append(dst, b)
+			continue
+		}
+		dst = appendRune(dst, rune(b))
+	}
+
+	return dst, len(src)
+}
+
+func singleByteDecoder(high *[128]rune) decoder {
+	return func(dst, src []byte, eof bool) ([]byte, int) {
+		for _, b := range src {
+			if b < utf8.RuneSelf {
+				dst = append(dst, b)
+				continue
+			}
+			dst = appendRune(dst, high[b-0x80])
+		}
+
+		return dst, len(src)
+	}
+}
+
+func utf16Decoder(bigEndian bool) decoder {
+	unit := func(p []byte) rune {
+		if bigEndian {
+			return rune(p[0])<<8 | rune(p[1])
+		}
+		return rune(p[1])<<8 | rune(p[0])
+	}
+
+	return func(dst, src []byte, eof bool) ([]byte, int) {
+		i := 0
+		for ; i+1 < len(src); i += 2 {
+			r := unit(src[i:])
+			if r < 0xd800 || r > 0xdfff {
+				dst = appendRune(dst, r)
+				continue
+			}
+
+			if r >= 0xdc00 {
+				// low surrogate without high one
+				dst = appendRune(dst, utf8.RuneError)
+				continue
+			}
+			if i+3 >= len(src) {
+				if !eof {
+					// waiting for the low surrogate
+					return dst, i
+				}
+				dst = appendRune(dst, utf8.RuneError)
+				continue
+			}
+
+			low := unit(src[i+2:])
+			if low < 0xdc00 || low > 0xdfff {
+				dst = appendRune(dst, utf8.RuneError)
+				continue
+			}
+			dst = appendRune(dst, 0x10000+(r-0xd800)<<10+(low-0xdc00))
+			i += 2
+		}
+
+		if eof && i < len(src) {
+			dst = appendRune(dst, utf8.RuneError)
+			i = len(src)
+		}
+
+		return dst, i
+	}
+}
+
+// decodeShiftJIS decodes windows-31j as browsers do,
+// invalid trail byte is decoded again if it's ASCII
+func decodeShiftJIS(dst, src []byte, eof bool) ([]byte, int) {
+	i := 0
+	for ; i < len(src); i++ {
+		b := src[i]
+		switch {
+		case b < utf8.RuneSelf || b == 0x80:
+			dst = appendRune(dst, rune(b))
+			continue
+		case b >= 0xa1 && b <= 0xdf:
+			// half-width katakana
+			dst = appendRune(dst, 0xff61+rune(b-0xa1))
+			continue
+		case b >= 0x81 && b <= 0x9f || b >= 0xe0 && b <= 0xfc:
+		default:
+			dst = appendRune(dst, utf8.RuneError)
+			continue
+		}
+
+		if i+1 == len(src) {
+			if !eof {
+				// waiting for the trail byte
+				return dst, i
+			}
+			dst = appendRune(dst, utf8.RuneError)
+			continue
+		}
+
+		t := src[i+1]
+		r := utf8.RuneError
+		if t >= 0x40 && t <= 0xfc {
+			lead := int(b - 0x81)
+			if b >= 0xe0 {
+				lead = int(b-0xe0) + 0xa0 - 0x81
+			}
+			r = rune(shiftJIS[lead][t-0x40])
+		}
+		dst = appendRune(dst, r)
+		if r != utf8.RuneError || t >= utf8.RuneSelf {
+			i++
+		}
+	}
+
+	return dst, i
+}
+
+func appendRune(dst []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+
+	return append(dst, buf[:n]...)
+}
+
+// utf8Reader decodes text read from r to UTF-8
+type utf8Reader struct {
+	r   io.Reader
+	dec decoder
+	buf []byte
+	in  []byte // not decoded yet
+	out []byte // decoded, not read yet
+	err error
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+
+		n, err := u.r.Read(u.buf)
+		u.in = append(u.in, u.buf[:n]...)
+		u.err = err
+
+		var used int
+		u.out, used = u.dec(u.out[:0], u.in, err != nil)
+		u.in = append(u.in[:0], u.in[used:]...)
+	}
+
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+
+	return n, nil
+}
+
+// decodeText detects charset of text read from body and returns
+// it decoded to UTF-8 if transcode is set. Text of charsets which
+// can't be decoded is returned as it is and error is logged for link.
+// Detected charset is returned as well.
+func decodeText(link, contentType string, body io.Reader, html, transcode bool) (io.Reader, string) {
+	br := bufio.NewReaderSize(body, charsetSniffLen)
+	head, _ := br.Peek(charsetSniffLen)
+
+	charset, bomLen := detectCharset(contentType, head, html)
+	if !transcode {
+		return br, charset
+	}
+
+	if bomLen > 0 {
+		_, _ = br.Discard(bomLen)
+	}
+	if charset == charsetUTF8 {
+		return br, charset
+	}
+
+	dec, ok := decoders[charset]
+	if !ok {
+		log.Printf("ERR: can't decode %s of %s to UTF-8, using it as it is", charset, link)
+		return br, charset
+	}
+
+	var decl io.Reader = strings.NewReader("")
+	if m := xmlEncoding.FindSubmatchIndex(head[bomLen:]); m != nil {
+		// declaration should not tell the old encoding
+		old := append([]byte(nil), head[bomLen:bomLen+m[1]]...)
+		decl = io.MultiReader(bytes.NewReader(old[:m[2]]), strings.NewReader("UTF-8"),
+			bytes.NewReader(old[m[3]:]))
+		_, _ = br.Discard(m[1])
+	}
+
+	return io.MultiReader(decl, &utf8Reader{r: br, dec: dec, buf: make([]byte, 32*1024)}), charset
+}
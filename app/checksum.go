@@ -0,0 +1,149 @@
+package app
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digestCheck compares hash of the response body
+// with the value of Content-MD5 or Digest header
+type digestCheck struct {
+	header string
+	h      hash.Hash
+	want   []byte
+}
+
+// digestAlgorithms are algorithms of Digest header which are checked
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// bodyDigests returns checks of digests sent in headers of resp.
+// Partial responses and bodies decompressed by transport
+// don't match digests of the whole file.
+func bodyDigests(resp *http.Response) []digestCheck {
+	if resp.StatusCode != http.StatusOK || resp.Uncompressed {
+		return nil
+	}
+
+	var checks []digestCheck
+	if v := resp.Header.Get("Content-MD5"); v != "" {
+		h := md5.New()
+		if want, ok := decodeDigest(v, h.Size()); ok {
+			checks = append(checks, digestCheck{header: "Content-MD5", h: h, want: want})
+		}
+	}
+
+	// e.g. Digest: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=
+	for _, v := range resp.Header["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			i := strings.Index(d, "=")
+			if i < 0 {
+				continue
+			}
+			alg := strings.ToLower(strings.TrimSpace(d[:i]))
+			newHash, ok := digestAlgorithms[alg]
+			if !ok {
+				continue
+			}
+
+			h := newHash()
+			if want, ok := decodeDigest(d[i+1:], h.Size()); ok {
+				checks = append(checks, digestCheck{header: "Digest " + alg, h: h, want: want})
+			}
+		}
+	}
+
+	return checks
+}
+
+// decodeDigest decodes base64 digest of size bytes,
+// some servers send hex instead
+func decodeDigest(v string, size int) ([]byte, bool) {
+	v = strings.TrimSpace(v)
+
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err == nil && len(b) == size {
+		return b, true
+	}
+
+	b, err = hex.DecodeString(v)
+	if err == nil && len(b) == size {
+		return b, true
+	}
+
+	return nil, false
+}
+
+// digestsWriter returns writer updating hashes of all checks
+func digestsWriter(checks []digestCheck) io.Writer {
+	writers := make([]io.Writer, len(checks))
+	for i, c := range checks {
+		writers[i] = c.h
+	}
+
+	return io.MultiWriter(writers...)
+}
+
+// verifyDigests returns error if any of hashes does not match
+func verifyDigests(checks []digestCheck) error {
+	for _, c := range checks {
+		got := c.h.Sum(nil)
+		if !bytes.Equal(got, c.want) {
+			return fmt.Errorf("%s mismatch: expected %x, got %x", c.header, c.want, got)
+		}
+	}
+
+	return nil
+}
+
+// saveHash keeps state of checksum of size bytes written to the
+// partial file, so checksum of the whole file is known after resume
+func (p *partialFile) saveHash(checksum hash.Hash, size int64) {
+	m, ok := checksum.(encoding.BinaryMarshaler)
+	if !ok {
+		return
+	}
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	p.Hash = base64.StdEncoding.EncodeToString(b)
+	p.Hashed = size
+}
+
+// restoreHash loads state of checksum saved for partial file of
+// offset bytes, false is returned if it's not known
+func (p *partialFile) restoreHash(checksum hash.Hash, offset int64) bool {
+	if p.Hash == "" || p.Hashed != offset {
+		return false
+	}
+
+	u, ok := checksum.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(p.Hash)
+	if err != nil {
+		return false
+	}
+
+	return u.UnmarshalBinary(b) == nil
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CompressedMode defines what to do with compressed text files
+// like 'data.csv.gz'
+type CompressedMode string
+
+const (
+	// CompressedIgnore does not consider compressed files text files
+	CompressedIgnore CompressedMode = "ignore"
+	// CompressedKeep stores compressed files as is
+	CompressedKeep CompressedMode = "keep"
+	// CompressedDecompress decompresses files while writing
+	// and stores them without compression extension
+	CompressedDecompress CompressedMode = "decompress"
+)
+
+// ParseCompressedMode parses mode name
+func ParseCompressedMode(s string) (CompressedMode, error) {
+	switch m := CompressedMode(s); m {
+	case CompressedIgnore, CompressedKeep, CompressedDecompress:
+		return m, nil
+	}
+
+	return "", errors.New("compressed mode should be one of: ignore, keep, decompress")
+}
+
+// WithCompressed sets how compressed text files are handled
+func WithCompressed(mode CompressedMode) Option {
+	return func(d *Downloader) {
+		d.compressed = mode
+	}
+}
+
+// codec is a compression format of text files.
+// Only formats which can be decompressed are supported,
+// content of compressed files is checked to be text.
+type codec struct {
+	ext    string
+	reader func(io.Reader) (io.Reader, error)
+	// sniffLen is how many bytes of compressed data are
+	// used to check if it contains text, it should be
+	// enough to decompress the beginning of content
+	sniffLen int
+}
+
+var codecs = []codec{
+	{
+		ext:      ".gz",
+		reader:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		sniffLen: 64 * 1024,
+	},
+	{
+		// nothing is decompressed until the whole block is read,
+		// block of incompressible data is a bit larger than 900k
+		ext:      ".bz2",
+		reader:   func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+		sniffLen: 1024 * 1024,
+	},
+}
+
+// unsupportedCodecs are compression formats which can't be
+// decompressed, text files compressed with them are skipped
+var unsupportedCodecs = []string{".zst", ".xz"}
+
+// compressedTextCodec returns codec if url points to compressed text file
+func compressedTextCodec(u *url.URL) (codec, bool) {
+	for _, c := range codecs {
+		if !strings.HasSuffix(u.Path, c.ext) {
+			continue
+		}
+
+		inner := *u
+		inner.Path = strings.TrimSuffix(u.Path, c.ext)
+		if urlIsTextFile(&inner) {
+			return c, true
+		}
+	}
+
+	return codec{}, false
+}
+
+// unsupportedTextCodec returns extension if url points to text
+// file compressed with format which is not supported
+func unsupportedTextCodec(u *url.URL) (string, bool) {
+	for _, ext := range unsupportedCodecs {
+		inner := *u
+		inner.Path = strings.TrimSuffix(u.Path, ext)
+		if inner.Path != u.Path && urlIsTextFile(&inner) {
+			return ext, true
+		}
+	}
+
+	return "", false
+}
+
+// isTextFile returns true if url points to text file
+// or compressed text file if they are processed
+func (d *Downloader) isTextFile(u *url.URL) bool {
+	if urlIsTextFile(u) {
+		return true
+	}
+
+	if d.compressed == CompressedIgnore {
+		return false
+	}
+
+	if _, ok := compressedTextCodec(u); ok {
+		return true
+	}
+
+	// it's recorded as skipped
+	_, ok := unsupportedTextCodec(u)
+	return ok
+}
+
+// decompressing is true if file is going to be decompressed while writing
+func (d *Downloader) decompressing(u *url.URL) bool {
+	_, ok := compressedTextCodec(u)
+
+	return ok && d.compressed == CompressedDecompress
+}
+
+// compressedIsText checks if beginning of compressed data is text.
+// Data which is not decompressed to anything is not text.
+func compressedIsText(c codec, head []byte) bool {
+	r, err := c.reader(bytes.NewReader(head))
+	if err != nil {
+		return false
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	if n == 0 {
+		return false
+	}
+
+	return strings.HasPrefix(http.DetectContentType(buf[:n]), "text/")
+}
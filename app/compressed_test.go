@@ -0,0 +1,117 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func codecByExt(t *testing.T, ext string) codec {
+	t.Helper()
+
+	for _, c := range codecs {
+		if c.ext == ext {
+			return c
+		}
+	}
+	t.Fatalf("no codec %s", ext)
+	return codec{}
+}
+
+func bzip2Data(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		t.Skip("bzip2 is not installed")
+	}
+	cmd := exec.Command("bzip2", "-c", "-9")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+// head returns beginning of data peeked for sniffing
+func head(data []byte, n int) []byte {
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
+
+func TestCompressedIsTextBzip2(t *testing.T) {
+	c := codecByExt(t, ".bz2")
+
+	binary := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(binary)
+	compressed := bzip2Data(t, binary)
+	if compressedIsText(c, head(compressed, c.sniffLen)) {
+		t.Fatal("large binary bz2 is text")
+	}
+	// nothing is decompressed from a part of the first block
+	if compressedIsText(c, head(compressed, 64*1024)) {
+		t.Fatal("truncated binary bz2 is text")
+	}
+
+	// the first block is not compressed much as well
+	text := []byte(strings.Repeat("line of text\n", 1000))
+	for i := 0; i < 2*1024*1024; i += 16 {
+		text = append(text, []byte(strings.Repeat("x", rand.Intn(16)))...)
+		text = append(text, byte('a'+rand.Intn(26)), '\n')
+	}
+	compressed = bzip2Data(t, text)
+	if !compressedIsText(c, head(compressed, c.sniffLen)) {
+		t.Fatal("large text bz2 is not text")
+	}
+}
+
+func TestCompressedIsTextGzip(t *testing.T) {
+	c := codecByExt(t, ".gz")
+
+	compress := func(data []byte) []byte {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		_, _ = w.Write(data)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	if !compressedIsText(c, compress([]byte("a,b\n1,2\n"))) {
+		t.Fatal("csv is not text")
+	}
+	if compressedIsText(c, compress([]byte{0, 1, 2, 3, 0xff, 0xfe})) {
+		t.Fatal("binary is text")
+	}
+	if compressedIsText(c, compress(nil)) {
+		t.Fatal("empty content is text")
+	}
+	if compressedIsText(c, []byte("not gzip")) {
+		t.Fatal("invalid gzip is text")
+	}
+}
+
+func TestUnsupportedTextCodec(t *testing.T) {
+	for link, want := range map[string]string{
+		"http://example.com/a.json.zst": ".zst",
+		"http://example.com/a.xml.xz":   ".xz",
+		"http://example.com/a.exe.xz":   "",
+		"http://example.com/a.zst":      "",
+		"http://example.com/a.csv.gz":   "",
+	} {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext, _ := unsupportedTextCodec(u)
+		if ext != want {
+			t.Errorf("%s: got %q, expected %q", link, ext, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats describes progress of the crawl
+type Stats struct {
+	Paused    bool  `json:"paused"`
+	Queued    int   `json:"queued"`
+	InFlight  int   `json:"in_flight"`
+	PagesDone int64 `json:"pages_done"`
+	FilesDone int64 `json:"files_done"`
+}
+
+// Pause stops taking new urls keeping the frontier and state.
+// Downloads in flight are finished.
+func (d *Downloader) Pause() {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+
+	select {
+	case <-d.running:
+		d.running = make(chan struct{})
+		log.Print("crawl paused")
+	default:
+		// already paused
+	}
+}
+
+// Resume continues crawl stopped by Pause
+func (d *Downloader) Resume() {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+
+	select {
+	case <-d.running:
+		// not paused
+	default:
+		close(d.running)
+		log.Print("crawl resumed")
+	}
+}
+
+// Paused returns true if crawl is paused
+func (d *Downloader) Paused() bool {
+	select {
+	case <-d.runningCh():
+		return false
+	default:
+		return true
+	}
+}
+
+// runningCh returns channel which is closed while crawl is not paused
+func (d *Downloader) runningCh() chan struct{} {
+	d.pauseLock.Lock()
+	defer d.pauseLock.Unlock()
+
+	return d.running
+}
+
+// Stats returns current progress of the crawl
+func (d *Downloader) Stats() Stats {
+	queued, inflight := d.frontier.stats()
+
+	return Stats{
+		Paused:    d.Paused(),
+		Queued:    queued,
+		InFlight:  inflight,
+		PagesDone: atomic.LoadInt64(&d.pagesDone),
+		FilesDone: atomic.LoadInt64(&d.filesDone),
+	}
+}
+
+// ControlHandler returns http handler which allows to control the crawl:
+//
+//	GET  /status - Stats as json
+//	POST /pause
+//	POST /resume
+func (d *Downloader) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Stats())
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d.Pause()
+		writeJSON(w, d.Stats())
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d.Resume()
+		writeJSON(w, d.Stats())
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("ERR: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// coordinatorPoll is how often coordinator checks progress of workers
+var coordinatorPoll = 5 * time.Second
+
+// Coordinator starts distributed crawl in shared store,
+// waits until workers process it and saves records to state
+type Coordinator struct {
+	store     *SharedStore
+	order     CrawlOrder
+	stateFile string
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewCoordinator creates coordinator saving state to stateDir
+func NewCoordinator(store *SharedStore, stateDir string, order CrawlOrder) *Coordinator {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Coordinator{
+		store:     store,
+		order:     order,
+		stateFile: stateFilePath(stateDir),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Run starts crawl from input or continues unfinished one
+// and waits until it's finished. State is saved when crawl
+// is finished or stopped, crawl stopped with Shutdown
+// is continued by the next Run.
+func (c *Coordinator) Run(input string) error {
+	u, err := url.Parse(input)
+	if err != nil {
+		return errors.New("invalid input URL")
+	}
+
+	n, err := c.store.pending()
+	if err != nil {
+		return err
+	}
+
+	base := ""
+	if n > 0 {
+		base, err = redisString(c.store.client.Do("GET", c.store.key("base")))
+		if err != nil && err != errRedisNil {
+			return err
+		}
+	}
+
+	switch {
+	case n == 0 || base == "":
+		// base is not set if previous start failed
+		err = c.start(u)
+		if err != nil {
+			return err
+		}
+	case base != u.String():
+		return fmt.Errorf("shared store has unfinished crawl of %s, "+
+			"wait until it's finished or use another prefix for %s", base, u)
+	default:
+		log.Printf("continuing distributed crawl, %d items left", n)
+	}
+
+	ticker := time.NewTicker(coordinatorPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.saveState()
+			return ErrInterrupted
+		case <-ticker.C:
+		}
+
+		n, err = c.store.pending()
+		if err != nil {
+			log.Printf("ERR: failed to check shared frontier: %v", err)
+			continue
+		}
+
+		processed, err := redisInt(c.store.client.Do("HLEN", c.store.key("records")))
+		if err != nil {
+			log.Printf("ERR: failed to check records: %v", err)
+			continue
+		}
+
+		log.Printf("%d processed, %d left", processed, n)
+		if n == 0 {
+			c.saveState()
+
+			// workers started later wait for the next crawl
+			_, err = c.store.client.Do("DEL", c.store.key("base"))
+			if err != nil {
+				log.Printf("ERR: failed to finish distributed crawl: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+// start removes previous crawl from shared store and queues u
+func (c *Coordinator) start(u *url.URL) error {
+	s := c.store
+
+	// workers don't start until base is set
+	_, err := s.client.Do("DEL", s.key("base"), s.key("seen"), s.key("records"), s.key("seq"))
+	if err != nil {
+		return err
+	}
+
+	item := frontierItem{URL: u.String()}
+	_, err = s.client.Do("SADD", s.key("seen"), "u "+item.URL)
+	if err != nil {
+		return err
+	}
+
+	err = s.push(item, c.order)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Do("SET", s.key("base"), u.String())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("distributed crawl of %s started", u)
+
+	return nil
+}
+
+// Shutdown stops waiting for workers, they continue working
+// and crawl can be continued by the next Run
+func (c *Coordinator) Shutdown(time.Duration) {
+	c.cancel()
+}
+
+// saveState saves records reported by workers
+func (c *Coordinator) saveState() {
+	s := &state{
+		Version: stateVersion,
+		URLs:    make(map[string]*record),
+		Files:   make(map[string]*record),
+		Order:   c.order,
+		Sink:    sinkWorkers,
+	}
+
+	err := c.store.records(func(kind, link string, r *record) {
+		if kind == KindFile {
+			s.Files[link] = r
+		} else {
+			s.URLs[link] = r
+		}
+	})
+	if err != nil {
+		log.Printf("ERR: failed to read records: %v", err)
+		return
+	}
+
+	err = writeState(c.stateFile, s)
+	if err != nil {
+		log.Printf("ERR: failed to save state: %+v", err)
+		return
+	}
+	log.Print("state saved")
+}
+
+// records calls fn for every record reported by workers
+func (s *SharedStore) records(fn func(kind, link string, r *record)) error {
+	cursor := "0"
+	for {
+		reply, err := s.client.Do("HSCAN", s.key("records"), cursor, "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return errors.New("redis: unexpected HSCAN reply")
+		}
+		cursor, err = redisString(parts[0], nil)
+		if err != nil {
+			return err
+		}
+		fields, err := redisStrings(parts[1], nil)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			kind, link := splitRecordKey(fields[i])
+			r := &record{}
+			err = json.Unmarshal([]byte(fields[i+1]), r)
+			if err != nil {
+				log.Printf("WARN: invalid record of %s: %v", link, err)
+				continue
+			}
+			fn(kind, link, r)
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func splitRecordKey(key string) (string, string) {
+	i := strings.IndexByte(key, ' ')
+	if i < 0 {
+		return KindPage, key
+	}
+
+	return key[:i], key[i+1:]
+}
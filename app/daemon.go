@@ -0,0 +1,214 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// JobSummary describes state and the last run of a daemon job
+type JobSummary struct {
+	Name         string    `json:"name"`
+	BaseURL      string    `json:"base_url"`
+	Running      bool      `json:"running"`
+	NextRun      time.Time `json:"next_run"`
+	LastStart    time.Time `json:"last_start,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastResult   string    `json:"last_result,omitempty"` // complete, interrupted or failed
+	LastError    string    `json:"last_error,omitempty"`
+	PagesDone    int64     `json:"pages_done"`
+	FilesDone    int64     `json:"files_done"`
+	Runs         int       `json:"runs"`
+}
+
+type daemonJob struct {
+	schedule   Schedule
+	downloader *Downloader
+	summary    JobSummary
+}
+
+// Daemon re-crawls jobs on their schedules.
+// Every job keeps its Downloader with state between runs.
+type Daemon struct {
+	jobs   []*daemonJob
+	lock   sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDaemon creates daemon without jobs
+func NewDaemon() *Daemon {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Daemon{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// AddJob adds job crawling baseURL with d on schedule.
+// It should be called before Run.
+func (dm *Daemon) AddJob(name, baseURL string, schedule Schedule, d *Downloader) {
+	dm.jobs = append(dm.jobs, &daemonJob{
+		schedule:   schedule,
+		downloader: d,
+		summary:    JobSummary{Name: name, BaseURL: baseURL},
+	})
+}
+
+// Run runs jobs on their schedules until Shutdown is called
+func (dm *Daemon) Run() {
+	for _, job := range dm.jobs {
+		dm.wg.Add(1)
+		go func() {
+			dm.runJob(job)
+			dm.wg.Done()
+		}()
+	}
+
+	dm.wg.Wait()
+}
+
+func (dm *Daemon) runJob(job *daemonJob) {
+	// interval is counted from the previous run, the first one is at start
+	_, interval := job.schedule.(intervalSchedule)
+	first := true
+
+	for {
+		next := job.schedule.Next(time.Now())
+		if interval && first {
+			next = time.Now()
+		}
+		first = false
+		if next.IsZero() {
+			log.Printf("job %s: schedule has no next run", job.summary.Name)
+			return
+		}
+
+		dm.lock.Lock()
+		job.summary.NextRun = next
+		dm.lock.Unlock()
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-dm.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		dm.runOnce(job)
+
+		if dm.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (dm *Daemon) runOnce(job *daemonJob) {
+	log.Printf("job %s: starting", job.summary.Name)
+
+	start := time.Now()
+	dm.lock.Lock()
+	job.summary.Running = true
+	job.summary.LastStart = start
+	dm.lock.Unlock()
+
+	err := job.downloader.Run(job.summary.BaseURL)
+	stats := job.downloader.Stats()
+
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	s := &job.summary
+	s.Running = false
+	s.Runs++
+	s.LastDuration = time.Since(start).String()
+	s.PagesDone = stats.PagesDone
+	s.FilesDone = stats.FilesDone
+	s.LastError = ""
+
+	switch err {
+	case nil:
+		s.LastResult = "complete"
+	case ErrInterrupted:
+		s.LastResult = "interrupted"
+	default:
+		s.LastResult = "failed"
+		s.LastError = err.Error()
+	}
+
+	log.Printf("job %s: %s in %s", s.Name, s.LastResult, s.LastDuration)
+}
+
+// Summaries returns state of all jobs
+func (dm *Daemon) Summaries() []JobSummary {
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+
+	res := make([]JobSummary, 0, len(dm.jobs))
+	for _, job := range dm.jobs {
+		res = append(res, job.summary)
+	}
+
+	return res
+}
+
+// Pause pauses all jobs
+func (dm *Daemon) Pause() {
+	for _, job := range dm.jobs {
+		job.downloader.Pause()
+	}
+}
+
+// Resume resumes all jobs
+func (dm *Daemon) Resume() {
+	for _, job := range dm.jobs {
+		job.downloader.Resume()
+	}
+}
+
+// Shutdown stops scheduling new runs and shuts down running ones,
+// see Downloader.Shutdown. Run returns when runs are finished.
+func (dm *Daemon) Shutdown(drain time.Duration) {
+	dm.cancel()
+
+	for _, job := range dm.jobs {
+		job.downloader.Shutdown(drain)
+	}
+}
+
+// ControlHandler returns http handler with summary of jobs:
+//
+//	GET  /jobs
+//	POST /pause
+//	POST /resume
+func (dm *Daemon) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, dm.Summaries())
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dm.Pause()
+		writeJSON(w, dm.Summaries())
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dm.Resume()
+		writeJSON(w, dm.Summaries())
+	})
+
+	return mux
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIntervalScheduleRunsAtStart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html></html>`)
+	}))
+	defer srv.Close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-daemon-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	schedule, err := ParseSchedule("@every 1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm := NewDaemon()
+	dm.AddJob("test", srv.URL+"/", schedule,
+		NewDownloader("", stateDir, 2, 10, WithSink(NewMemorySink())))
+
+	done := make(chan struct{})
+	go func() {
+		dm.Run()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// the next run is the interval after the first one
+		s := dm.Summaries()[0]
+		if s.Runs == 1 && time.Until(s.NextRun) > 59*time.Minute {
+			if s.LastResult != "complete" {
+				t.Errorf("result: %s %s", s.LastResult, s.LastError)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is not run at start: %+v", dm.Summaries()[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dm.Shutdown(0)
+	<-done
+}
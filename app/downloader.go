@@ -5,9 +5,11 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -16,50 +18,128 @@ import (
 // Downloader is a crawler which parses incoming url
 // and stores text files to disk
 type Downloader struct {
-	urls          map[string]bool
-	files         map[string]bool
+	// accessed atomically, first in struct for 64-bit alignment
+	pagesDone int64
+	filesDone int64
+
+	urls          map[string]*record // with disk seen set only pending urls are here
+	files         map[string]*record
+	seen          seenSet // nil if urls and files maps are used
+	seenMode      SeenMode
+	seenExpected  int
+	journal       recordLog // records of processed urls with disk seen set
 	restoredURLs  []*url.URL
 	restoredFiles []*url.URL
-	urlsCh        chan *url.URL
+	frontier      queue
+	shared        *SharedStore // frontier, seen urls and records of distributed crawl
+	order         CrawlOrder
+	weights       []PatternWeight
+	useSitemap    bool
+	sitemap       map[string]float64 // url -> sitemap priority
+	restoredItems []frontierItem
 	urlsLock      sync.RWMutex
 	filesLock     sync.RWMutex
 	client        *http.Client
-	limiter       chan interface{} // limits number of simultaneous downloads
+	credentials   map[string]Credentials
+	headers       http.Header
+	hostHeaders   map[string]http.Header
+	threads       int // number of simultaneous downloads
+	queueMemory   int
 	baseURL       *url.URL
-	urlsWG        sync.WaitGroup
-	wg            sync.WaitGroup
+	seeds         []*url.URL // crawled in addition to baseURL
+	scope         []*url.URL // baseURL and seeds if empty
 	stateFile     string
-	outDir        string
+	stateDir      string
+	started       bool           // state was loaded by previous Run
+	retryOnly     bool           // only failed urls from state are fetched
+	kept          []frontierItem // with retryOnly pages left for the next run
+	keptLock      sync.Mutex
+	sink          Sink
 	cancel        context.CancelFunc
-	ctx           context.Context
+	ctx           context.Context // cancels requests
+	stopDispatch  context.CancelFunc
+	dispatchCtx   context.Context // stops taking new urls
+	running       chan struct{}   // closed while not paused
+	drainLock     sync.Mutex
+	drainTimer    *time.Timer // cancels downloads in flight after Shutdown
+	pauseLock     sync.Mutex
 	timeout       time.Duration
+	maxFileSize   int64 // 0 means no limit
+	maxPageSize   int64
+	maxDepth      int // 0 means no limit
+	compressed    CompressedMode
+	charset       CharsetMode
+	meta          bool // metadata of files is written
+	metaSink      Sink // sink if nil
+	renderer      Renderer
+	filter        FileFilter
 }
 
-func NewDownloader(outDir, stateDir string, threads, timeout int) *Downloader {
-	limiter := make(chan interface{}, 10)
-	for i := 0; i < threads; i++ {
-		limiter <- true
+// Option configures optional Downloader settings
+type Option func(*Downloader)
+
+// WithSink makes Downloader store files in s
+// instead of outDir on local filesystem.
+// Remote sinks like S3Sink use transport of Downloader.
+func WithSink(s Sink) Option {
+	return func(d *Downloader) {
+		d.sink = s
 	}
+}
 
+func NewDownloader(outDir, stateDir string, threads, timeout int, opts ...Option) *Downloader {
 	ctx, cancel := context.WithCancel(context.Background())
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
 
-	return &Downloader{
-		urls:          make(map[string]bool, 100),
-		files:         make(map[string]bool, 100),
+	d := &Downloader{
+		urls:          make(map[string]*record, 100),
+		files:         make(map[string]*record, 100),
+		compressed:    CompressedIgnore,
+		charset:       CharsetIgnore,
+		renderer:      RawRenderer{},
 		restoredURLs:  make([]*url.URL, 0, 100),
 		restoredFiles: make([]*url.URL, 0, 100),
-		urlsCh:        make(chan *url.URL),
-		client:        http.DefaultClient,
-		limiter:       limiter,
-		outDir:        outDir,
-		stateFile:     path.Join(stateDir, "state.yaml"),
+		order:         OrderBFS,
+		credentials:   make(map[string]Credentials),
+		headers:       http.Header{"User-Agent": {DefaultUserAgent}},
+		hostHeaders:   make(map[string]http.Header),
+		threads:       threads,
+		queueMemory:   10000,
+		seenMode:      SeenMemory,
+		sink:          NewFSSink(outDir),
+		stateFile:     stateFilePath(stateDir),
+		stateDir:      stateDir,
 		ctx:           ctx,
 		cancel:        cancel,
+		dispatchCtx:   dispatchCtx,
+		stopDispatch:  stopDispatch,
+		running:       make(chan struct{}),
 		timeout:       time.Duration(timeout) * time.Second,
 	}
+	d.client = &http.Client{CheckRedirect: d.checkRedirect}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+	if s, ok := d.sink.(remoteSink); ok {
+		s.useTransport(d.client.Transport)
+	}
+	close(d.running)
+	if d.shared != nil {
+		d.frontier = d.shared.frontier(d.order)
+	} else {
+		d.frontier = newFrontier(d.order, d.queueMemory, path.Join(stateDir, "queue"))
+	}
+
+	return d
 }
 
-// Run starts crawling from the 'input' URL
+// ErrInterrupted is returned by Run if crawl was stopped
+// before all urls were processed
+var ErrInterrupted = errors.New("crawl interrupted")
+
+// Run starts crawling from the 'input' URL.
+// State is saved when crawl is finished or stopped.
 func (d *Downloader) Run(input string) error {
 	u, err := url.Parse(input)
 	if err != nil {
@@ -68,33 +148,153 @@ func (d *Downloader) Run(input string) error {
 
 	d.baseURL = u
 
+	atomic.StoreInt64(&d.pagesDone, 0)
+	atomic.StoreInt64(&d.filesDone, 0)
+
+	if d.order == OrderPriority && d.useSitemap {
+		d.loadSitemap(d.ctx)
+	}
+
+	if d.started {
+		// state is already in memory
+		if ds, ok := d.seen.(*diskSeenSet); ok {
+			ds.setClean(false)
+		}
+		err = d.newPass(u)
+	} else {
+		err = d.start(u)
+		d.started = true
+	}
+	if err != nil {
+		return err
+	}
+
+	d.runWorkers(d.dispatchCtx, d.ctx)
+	d.stopDrain()
+	complete := d.frontier.empty() && d.ctx.Err() == nil
+
+	log.Print("saving state...")
+	d.saveState()
+	log.Print("state saved")
+
+	if !complete {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// start loads state and queues pages left from the previous run
+// or the input url if there is no state
+func (d *Downloader) start(u *url.URL) error {
+	// queue chunks left by a crashed run, pending pages are in state
+	err := os.RemoveAll(path.Join(d.stateDir, "queue"))
+	if err != nil {
+		return err
+	}
+
+	if d.seenMode == SeenDisk {
+		ds, err := openDiskSeenSet(path.Join(d.stateDir, "seen"), d.seenExpected)
+		if err != nil {
+			log.Printf("ERR: failed to open seen urls: %v", err)
+			return err
+		}
+		// marked clean again when state is saved
+		ds.setClean(false)
+		d.seen = ds
+
+		d.journal, err = openJournal(path.Join(d.stateDir, journalFile))
+		if err != nil {
+			log.Printf("ERR: failed to open journal: %v", err)
+			return err
+		}
+	}
+
 	err = d.loadState()
-	if err == errNoState {
-		d.addURL(d.ctx, u)
+	if err == ErrNoState && !d.retryOnly {
+		if d.seenMode == SeenDisk {
+			// left by removed state or a run which crashed before saving it
+			err = d.resetSeen()
+			if err != nil {
+				return err
+			}
+		}
+		d.addSeeds(u)
 	} else if err != nil {
 		log.Printf("ERR: failed to load state: %v", err)
 		return err
 	} else {
-		// starting download of old urls
-		for _, u := range d.restoredURLs {
-			d.addURL(d.ctx, u)
-		}
+		d.restoreFrontier()
+	}
+
+	return nil
+}
 
+// WithRetryFailed makes Downloader fetch again only pages and files
+// which failed in previous runs. Queued pages and links found
+// while retrying are kept in state for the next run.
+func WithRetryFailed() Option {
+	return func(d *Downloader) {
+		d.retryOnly = true
 	}
+}
 
-	c := d.processNewURLsV2(d.ctx)
-	d.processNewFilesV2(d.ctx, c)
+// newPass starts crawling again from u if previous run was complete,
+// otherwise previous run is continued
+func (d *Downloader) newPass(u *url.URL) error {
+	if !d.frontier.empty() {
+		return nil
+	}
+
+	d.urlsLock.Lock()
+	d.urls = make(map[string]*record, len(d.urls))
+	d.urlsLock.Unlock()
+
+	d.filesLock.Lock()
+	d.files = make(map[string]*record, len(d.files))
+	d.filesLock.Unlock()
+
+	if d.seen != nil {
+		err := d.resetSeen()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.addSeeds(u)
 
-	log.Print("saving state...")
-	d.saveState()
-	log.Print("state saved")
 	return nil
 }
 
+// Stop cancels crawl immediately, downloads in flight are thrown away
 func (d *Downloader) Stop() {
 	d.cancel()
 }
 
+// Shutdown stops taking new urls and lets downloads in flight
+// finish for up to drain, then cancels them
+func (d *Downloader) Shutdown(drain time.Duration) {
+	d.stopDispatch()
+
+	d.drainLock.Lock()
+	defer d.drainLock.Unlock()
+	if d.drainTimer != nil {
+		return
+	}
+	d.drainTimer = time.AfterFunc(drain, func() {
+		log.Printf("drain timeout, cancelling downloads in flight")
+		d.cancel()
+	})
+}
+
+// stopDrain stops drain timeout of Shutdown when run is finished
+func (d *Downloader) stopDrain() {
+	d.drainLock.Lock()
+	defer d.drainLock.Unlock()
+	if d.drainTimer != nil {
+		d.drainTimer.Stop()
+	}
+}
+
 var textExtensions = []string{
 	".txt",
 	".md",
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainStopsWithRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html></html>`)
+	}))
+	defer srv.Close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-drain-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	d := NewDownloader("", stateDir, 2, 10, WithSink(NewMemorySink()))
+	d.Shutdown(50 * time.Millisecond)
+
+	// the seed could be taken before dispatch is stopped
+	err = d.Run(srv.URL + "/")
+	if err != nil && err != ErrInterrupted {
+		t.Fatalf("run: %v", err)
+	}
+
+	// drain timeout is stopped when run returns
+	time.Sleep(100 * time.Millisecond)
+	if d.ctx.Err() != nil {
+		t.Fatal("downloader is cancelled after run returned")
+	}
+}
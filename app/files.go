@@ -1,107 +1,240 @@
 package app
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"sync"
+	"strings"
 	"time"
 )
 
-// processNewFiles reads from filesCh
-// and downloads them
-func (d *Downloader) processNewFilesV2(ctx context.Context, filesCh chan *url.URL) {
-	wg := &sync.WaitGroup{}
-
-	for u := range filesCh {
-		wg.Add(1)
-		go func() {
-			d.processNewFile(ctx, u)
-			wg.Done()
-		}()
-	}
-
-	wg.Wait()
-}
-
-func (d *Downloader) addFile(ctx context.Context, u *url.URL, filesCh chan *url.URL) {
+// addFile queues file found on referer page if it was not queued before
+func (d *Downloader) addFile(u *url.URL, depth int, referer string) {
 	input := u.String()
 
 	d.filesLock.Lock()
 
 	// check if url was not processed
-	if _, ok := d.files[input]; ok {
+	if d.seenFile(input) {
 		d.filesLock.Unlock()
 		return
 	}
 
-	d.files[input] = false
+	if d.seen == nil {
+		// with disk seen set or shared store pending files
+		// are kept only in the frontier
+		r := newRecord()
+		r.Referer = referer
+		d.files[input] = r
+	}
 	d.filesLock.Unlock()
 
-	select {
-	case filesCh <- u:
-	case <-ctx.Done():
+	item := frontierItem{URL: input, Depth: depth, File: true, Referer: referer}
+	if d.retryOnly {
+		// downloaded by the next run
+		d.keptLock.Lock()
+		d.kept = append(d.kept, item)
+		d.keptLock.Unlock()
+		return
 	}
+
+	d.frontier.push(item)
 }
 
-func (d *Downloader) processNewFile(ctx context.Context, u *url.URL) {
+// restoreFile queues pending file from the state
+func (d *Downloader) restoreFile(u *url.URL) {
 	input := u.String()
 
-	select {
-	case <-ctx.Done():
+	d.filesLock.Lock()
+	referer := d.fileRecord(input).Referer
+	d.filesLock.Unlock()
+
+	d.frontier.push(frontierItem{URL: input, File: true, Referer: referer})
+}
+
+func (d *Downloader) processNewFile(ctx context.Context, item frontierItem) {
+	input := item.URL
+
+	u, err := url.Parse(input)
+	if err != nil {
+		d.failFile(ctx, input, 0, err)
+		return
+	}
+
+	if ext, ok := unsupportedTextCodec(u); ok {
+		d.skipFile(input, 0, ext+" compression is not supported")
 		return
-	case <-d.limiter:
+	}
+
+	partial, offset := d.resumeOffset(input)
+
+	c, compressed := compressedTextCodec(u)
+	fetch := func(offset int64) (*http.Response, error) {
+		req := d.buildRequest(ctx, input)
+		if offset > 0 {
+			setRangeHeaders(req, partial, offset)
+		}
+		if compressed {
+			// preventing transparent decompression by transport
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		return d.client.Do(req)
 	}
 
 	log.Printf("GET %s", input)
+	d.attemptFile(input)
 	now := time.Now()
-	req := d.buildRequest(ctx, input)
-	resp, err := d.client.Do(req)
+	resp, err := fetch(offset)
 	log.Printf("Done %s, took: %v", input, time.Since(now))
 
-	d.limiter <- true
+	if err == nil && offset > 0 && resp.StatusCode != http.StatusOK &&
+		!(resp.StatusCode == http.StatusPartialContent && validRange(resp, offset)) {
+		// e.g. 416 for a partial file which was complete,
+		// the same Range would fail on every run
+		log.Printf("can't resume %s: http %d, downloading from scratch", input, resp.StatusCode)
+		closeC(resp.Body)
+		d.forgetPartial(input, partial.Name)
+		offset = 0
+		resp, err = fetch(0)
+	}
+
 	if err != nil {
-		log.Printf("ERR: failed to download file %s: %v", input, err)
+		d.failFile(ctx, input, 0, err)
 		return
 	}
 	defer closeC(resp.Body)
 
-	if resp.StatusCode != 200 {
-		log.Printf("ERR: invalid code %s: %d", input, resp.StatusCode)
+	resumed := offset > 0 && resp.StatusCode == http.StatusPartialContent
+
+	if resp.StatusCode != 200 && !resumed {
+		d.failFile(ctx, input, resp.StatusCode, fmt.Errorf("http %d", resp.StatusCode))
 		return
 	}
 
-	urlPath := resp.Request.URL.Path
+	var written int64
+	var name string
+	var f SinkFile
+	var charset string
+
+	// digests in headers are of the body as it's sent
+	var raw io.Reader = resp.Body
+	checks := bodyDigests(resp)
+	if len(checks) > 0 {
+		raw = io.TeeReader(resp.Body, digestsWriter(checks))
+	}
+	body := raw
+
+	if resumed {
+		log.Printf("resuming %s from %d bytes", input, offset)
+		written = offset
+		name = partial.Name
+		if d.charset != CharsetIgnore {
+			// the beginning of the file is not available
+			charset, _ = detectCharset(resp.Header.Get("Content-Type"), nil, false)
+		}
+		f, err = d.sink.(ResumableSink).Resume(name)
+	} else {
+		if d.maxFileSize > 0 && resp.ContentLength > d.maxFileSize {
+			d.skipFile(input, resp.StatusCode, tooLarge(resp.ContentLength, d.maxFileSize))
+			return
+		}
+
+		urlPath := resp.Request.URL.Path
+
+		_, filename := path.Split(urlPath)
+		hash := hashURL(resp.Request.URL.String()) // to prevent check of unique filenames
+		name = hash + "_" + filename
 
-	_, filename := path.Split(urlPath)
-	hash := hashURL(resp.Request.URL.String()) // to prevent check of unique filenames
-	fullPath := path.Join(d.outDir, hash+"_"+filename)
-	tmpPath := fullPath + ".tmp"
+		if compressed {
+			src := bufio.NewReaderSize(raw, c.sniffLen)
+			head, _ := src.Peek(c.sniffLen)
+			if !compressedIsText(c, head) {
+				d.skipFile(input, resp.StatusCode, "compressed content is not text")
+				return
+			}
+			body = src
+
+			if d.compressed == CompressedDecompress {
+				body, err = c.reader(src)
+				if err != nil {
+					d.failFile(ctx, input, resp.StatusCode, fmt.Errorf("failed to decompress: %v", err))
+					return
+				}
+				name = strings.TrimSuffix(name, c.ext)
+			}
+		}
 
-	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if d.charset != CharsetIgnore && (!compressed || d.compressed == CompressedDecompress) {
+			body, charset = decodeText(input, resp.Header.Get("Content-Type"), body, false, d.charset == CharsetUTF8)
+		}
+
+		if offset > 0 && name != partial.Name {
+			d.dropPartial(partial.Name)
+		}
+		f, err = d.sink.Create(name)
+	}
 	if err != nil {
-		log.Printf("ERR: failed to open file: %v", err)
+		d.failFile(ctx, input, resp.StatusCode, fmt.Errorf("failed to open file: %v", err))
 		return
 	}
 
+	cf := d.newContentFilter()
+	if cf != nil {
+		defer cf.close()
+		if compressed && !d.decompressing(u) {
+			cf.decompress(c)
+		}
+		body = io.TeeReader(body, cf)
+	}
+
+	// checksum of the stored file, resumed files are hashed
+	// if state of the hash was kept when they were suspended
+	checksum := sha256.New()
+	if resumed && !partial.restoreHash(checksum, offset) {
+		log.Printf("checksum of %s is not known", input)
+		checksum = nil
+	} else {
+		body = io.TeeReader(body, checksum)
+	}
+
 downloadLoop:
 	for {
 		select {
 		case <-ctx.Done():
-			closeC(f)
-			cleanTmp(tmpPath)
+			d.suspendFile(input, name, f, resp, checksum, written)
 			return
 		default:
-			_, err := io.CopyN(f, resp.Body, 64*1024)
+			n, err := io.CopyN(f, body, 64*1024)
+			written += n
 			if err != nil && err != io.EOF {
-				log.Printf("ERR: download failed: %v", err)
-				closeC(f)
-				cleanTmp(tmpPath)
+				if ctx.Err() != nil {
+					// interrupted, keeping what we have for the next run
+					d.suspendFile(input, name, f, resp, checksum, written)
+					return
+				}
+				abortC(f)
+				d.failFile(ctx, input, resp.StatusCode, err)
+				return
+			}
+
+			if d.maxFileSize > 0 && written > d.maxFileSize {
+				abortC(f)
+				d.skipFile(input, resp.StatusCode, tooLarge(written, d.maxFileSize))
+				return
+			}
+			if d.filter.MaxSize > 0 && written > d.filter.MaxSize {
+				abortC(f)
+				d.filterFile(input, resp.StatusCode, fmt.Sprintf("size exceeds %d", d.filter.MaxSize))
 				return
 			}
 			if err == io.EOF {
@@ -110,21 +243,63 @@ downloadLoop:
 		}
 	}
 
-	err = f.Close()
-	if err != nil {
-		log.Printf("ERR: failed to close file: %v", err)
-		cleanTmp(tmpPath)
+	if len(checks) > 0 {
+		// decompressor could stop before the end of the body
+		_, err = io.Copy(ioutil.Discard, raw)
+		if err == nil {
+			err = verifyDigests(checks)
+		}
+		if err != nil {
+			abortC(f)
+			d.failFile(ctx, input, resp.StatusCode, err)
+			return
+		}
+	}
+
+	// content of compressed files is checked decompressed
+	if reason := d.filterReason(cf, resp, written, compressed); reason != "" {
+		abortC(f)
+		d.filterFile(input, resp.StatusCode, reason)
 		return
 	}
 
-	err = os.Rename(tmpPath, fullPath)
+	err = f.Commit()
 	if err != nil {
-		log.Printf("failed to rename %s -> %s: %v", tmpPath, fullPath, err)
+		d.failFile(ctx, input, resp.StatusCode, fmt.Errorf("failed to commit file %s: %v", name, err))
 		return
 	}
 
+	var sum string
+	if checksum != nil {
+		sum = hex.EncodeToString(checksum.Sum(nil))
+	}
+
+	if d.meta {
+		m := &fileMeta{
+			URL:       input,
+			FinalURL:  resp.Request.URL.String(),
+			Referer:   item.Referer,
+			Status:    resp.StatusCode,
+			Headers:   resp.Header,
+			Requested: now,
+			Completed: time.Now(),
+			Size:      written,
+			SHA256:    sum,
+			Charset:   charset,
+			Resumed:   resumed,
+		}
+		d.writeMeta(name, m)
+	}
+
 	d.filesLock.Lock()
-	d.files[input] = true
+	r := d.fileRecord(input)
+	r.Code = resp.StatusCode
+	r.Error = ""
+	r.Size = written
+	r.Output = name
+	r.SHA256 = sum
+	r.Charset = charset
+	d.doneFile(input, StatusDone)
 	d.filesLock.Unlock()
 }
 
@@ -134,6 +309,14 @@ func hashURL(link string) string {
 	return hex.EncodeToString(s[:])
 }
 
+// abortC aborts sink file and logs error if any
+func abortC(f SinkFile) {
+	err := f.Abort()
+	if err != nil {
+		log.Printf("ERR: failed to abort file: %v", err)
+	}
+}
+
 func cleanTmp(fullPath string) {
 	err := os.Remove(fullPath)
 	if err != nil {
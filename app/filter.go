@@ -0,0 +1,364 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FileFilter rejects downloaded files which should not be stored,
+// they are discarded and recorded as filtered
+type FileFilter struct {
+	Types     []string         // allowed media types, e.g. text/csv or text/*
+	MinSize   int64            // of stored file, 0 - no limit
+	MaxSize   int64            // of stored file, 0 - no limit
+	Match     []*regexp.Regexp // content should match all of them
+	JSONPaths []JSONPath       // json document should have all of them
+}
+
+// WithFileFilter makes Downloader store only files passing f
+func WithFileFilter(f FileFilter) Option {
+	return func(d *Downloader) {
+		d.filter = f
+	}
+}
+
+// checksContent returns true if filter needs the whole content of files,
+// resumed downloads are fetched again then
+func (f *FileFilter) checksContent() bool {
+	return len(f.Types) > 0 || len(f.Match) > 0 || len(f.JSONPaths) > 0
+}
+
+// ParseMediaRange parses allowed media type like text/csv or text/*
+func ParseMediaRange(s string) (string, error) {
+	t := strings.ToLower(strings.TrimSpace(s))
+	parts := strings.Split(t, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == "*" && parts[1] != "*" {
+		return "", fmt.Errorf("invalid media type %q, should be like text/csv or text/*", s)
+	}
+
+	return t, nil
+}
+
+func matchMediaType(allowed []string, t string) bool {
+	for _, a := range allowed {
+		if a == t || a == "*/*" ||
+			strings.HasSuffix(a, "/*") && strings.HasPrefix(t, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// JSONPath is a path to a value in json document
+type JSONPath struct {
+	raw   string
+	steps []jsonStep
+}
+
+type jsonStep struct {
+	key   string
+	index int  // of array element if key is empty
+	any   bool // any array element
+}
+
+// ParseJSONPath parses path like $.data.items[0].id,
+// [*] matches any element of array
+func ParseJSONPath(s string) (JSONPath, error) {
+	p := JSONPath{raw: s}
+
+	rest := strings.TrimPrefix(strings.TrimSpace(s), "$")
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return p, fmt.Errorf("invalid json path %q: empty key", s)
+			}
+			p.steps = append(p.steps, jsonStep{key: rest[1:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return p, fmt.Errorf("invalid json path %q: ] expected", s)
+			}
+			idx := rest[1:end]
+			if idx == "*" {
+				p.steps = append(p.steps, jsonStep{any: true})
+			} else {
+				i, err := strconv.Atoi(idx)
+				if err != nil || i < 0 {
+					return p, fmt.Errorf("invalid json path %q: bad index %q", s, idx)
+				}
+				p.steps = append(p.steps, jsonStep{index: i})
+			}
+			rest = rest[end+1:]
+		default:
+			// the first key without a dot
+			rest = "." + rest
+		}
+	}
+
+	if len(p.steps) == 0 {
+		return p, fmt.Errorf("invalid json path %q: empty path", s)
+	}
+
+	return p, nil
+}
+
+func (p JSONPath) String() string {
+	return p.raw
+}
+
+// exists returns true if v has value at the path
+func (p JSONPath) exists(v interface{}) bool {
+	return jsonExists(v, p.steps)
+}
+
+func jsonExists(v interface{}, steps []jsonStep) bool {
+	if len(steps) == 0 {
+		return true
+	}
+	step := steps[0]
+
+	if step.key != "" {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		child, ok := obj[step.key]
+		return ok && jsonExists(child, steps[1:])
+	}
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return false
+	}
+	if !step.any {
+		return step.index < len(arr) && jsonExists(arr[step.index], steps[1:])
+	}
+	for _, child := range arr {
+		if jsonExists(child, steps[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterReason returns why stored file of size bytes is rejected,
+// empty if it passes. Type of decompressed content is sniffed.
+func (d *Downloader) filterReason(cf *contentFilter, resp *http.Response, size int64, decompressed bool) string {
+	if d.filter.MinSize > 0 && size < d.filter.MinSize {
+		return fmt.Sprintf("size %d is less than %d", size, d.filter.MinSize)
+	}
+	if cf == nil {
+		return ""
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if decompressed {
+		contentType = ""
+	}
+
+	return cf.reason(contentType)
+}
+
+// typeSniffLen is how many bytes are used by http.DetectContentType
+const typeSniffLen = 512
+
+// contentFilter checks content of a file while it's stored.
+// Every check reads the content from a pipe in its own goroutine.
+type contentFilter struct {
+	filter *FileFilter
+	head   []byte // for sniffing media type
+	checks []*streamCheck
+	closed bool
+
+	// content of file stored compressed is decompressed for checks
+	compressed   *io.PipeWriter
+	decompressed chan error
+}
+
+// newContentFilter returns nil if there is nothing to check in content
+func (d *Downloader) newContentFilter() *contentFilter {
+	if !d.filter.checksContent() {
+		return nil
+	}
+
+	c := &contentFilter{filter: &d.filter}
+	for _, re := range d.filter.Match {
+		re := re
+		c.checks = append(c.checks, newStreamCheck(func(r io.Reader) string {
+			if !re.MatchReader(bufio.NewReader(r)) {
+				return fmt.Sprintf("content does not match %s", re)
+			}
+			return ""
+		}))
+	}
+	if len(d.filter.JSONPaths) > 0 {
+		c.checks = append(c.checks, newStreamCheck(func(r io.Reader) string {
+			var v interface{}
+			dec := json.NewDecoder(r)
+			dec.UseNumber()
+			if err := dec.Decode(&v); err != nil {
+				return fmt.Sprintf("content is not json: %v", err)
+			}
+			for _, p := range d.filter.JSONPaths {
+				if !p.exists(v) {
+					return fmt.Sprintf("json has no %s", p)
+				}
+			}
+			return ""
+		}))
+	}
+
+	return c
+}
+
+// decompress makes filter check decompressed content
+// of file which is stored compressed
+func (c *contentFilter) decompress(cd codec) {
+	pr, pw := io.Pipe()
+	c.compressed = pw
+	c.decompressed = make(chan error, 1)
+
+	go func() {
+		r, err := cd.reader(pr)
+		if err == nil {
+			_, err = io.Copy(checksWriter{c}, r)
+		}
+		// the rest of the content is not needed
+		_, _ = io.Copy(ioutil.Discard, pr)
+		c.decompressed <- err
+	}()
+}
+
+// Write passes content to checks
+func (c *contentFilter) Write(p []byte) (int, error) {
+	if c.compressed != nil {
+		return c.compressed.Write(p)
+	}
+
+	return c.write(p)
+}
+
+// checksWriter passes decompressed content to checks of filter
+type checksWriter struct {
+	c *contentFilter
+}
+
+func (w checksWriter) Write(p []byte) (int, error) {
+	return w.c.write(p)
+}
+
+func (c *contentFilter) write(p []byte) (int, error) {
+	if len(c.head) < typeSniffLen {
+		n := typeSniffLen - len(c.head)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.head = append(c.head, p[:n]...)
+	}
+
+	for _, s := range c.checks {
+		_, err := s.pw.Write(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// reason returns why the whole content written is rejected, empty if
+// it passes. contentType is of the response, empty if content was
+// changed, e.g. decompressed. Type is sniffed from content if not known.
+func (c *contentFilter) reason(contentType string) string {
+	c.closed = true
+
+	var res string
+	if c.compressed != nil {
+		_ = c.compressed.Close()
+		if err := <-c.decompressed; err != nil {
+			res = fmt.Sprintf("failed to decompress content: %v", err)
+		}
+	}
+	for _, s := range c.checks {
+		_ = s.pw.Close()
+		if r := <-s.done; r != "" && res == "" {
+			res = r
+		}
+	}
+	if res != "" {
+		return res
+	}
+
+	if len(c.filter.Types) == 0 {
+		return ""
+	}
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil || t == "application/octet-stream" {
+		t, _, _ = mime.ParseMediaType(http.DetectContentType(c.head))
+	}
+	if !matchMediaType(c.filter.Types, t) {
+		return "media type " + t + " is not allowed"
+	}
+
+	return ""
+}
+
+// close stops checks if reason was not called
+func (c *contentFilter) close() {
+	if c == nil || c.closed {
+		return
+	}
+	c.closed = true
+
+	if c.compressed != nil {
+		_ = c.compressed.CloseWithError(errFilterStopped)
+		<-c.decompressed
+	}
+	for _, s := range c.checks {
+		_ = s.pw.CloseWithError(errFilterStopped)
+		<-s.done
+	}
+}
+
+var errFilterStopped = errors.New("download stopped")
+
+// streamCheck runs check on content written to pw
+type streamCheck struct {
+	pw   *io.PipeWriter
+	done chan string // why content is rejected, empty if it passes
+}
+
+func newStreamCheck(check func(r io.Reader) string) *streamCheck {
+	pr, pw := io.Pipe()
+	s := &streamCheck{pw: pw, done: make(chan string, 1)}
+
+	go func() {
+		reason := check(pr)
+		// the rest of the content is not needed
+		_, err := io.Copy(ioutil.Discard, pr)
+		if err != nil && err != errFilterStopped {
+			log.Printf("ERR: failed to check content: %v", err)
+		}
+		s.done <- reason
+	}()
+
+	return s
+}
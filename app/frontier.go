@@ -0,0 +1,600 @@
+package app
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CrawlOrder defines in which order discovered pages are crawled
+type CrawlOrder string
+
+const (
+	// OrderBFS crawls pages level by level
+	OrderBFS CrawlOrder = "bfs"
+	// OrderDFS crawls the most recently discovered pages first
+	OrderDFS CrawlOrder = "dfs"
+	// OrderPriority crawls pages with higher priority first,
+	// see WithPatternWeights and WithSitemapPriority.
+	// Pages with the same priority are crawled by depth.
+	OrderPriority CrawlOrder = "priority"
+)
+
+// ParseCrawlOrder parses order name
+func ParseCrawlOrder(s string) (CrawlOrder, error) {
+	switch o := CrawlOrder(s); o {
+	case OrderBFS, OrderDFS, OrderPriority:
+		return o, nil
+	}
+
+	return "", errors.New("order should be one of: bfs, dfs, priority")
+}
+
+// WithCrawlOrder sets order of crawling pages
+func WithCrawlOrder(o CrawlOrder) Option {
+	return func(d *Downloader) {
+		d.order = o
+	}
+}
+
+// PatternWeight adds Weight to priority of urls matching Pattern
+type PatternWeight struct {
+	Pattern *regexp.Regexp
+	Weight  float64
+}
+
+// ParsePatternWeight parses weight in form "regexp=weight"
+func ParsePatternWeight(s string) (PatternWeight, error) {
+	eq := strings.LastIndex(s, "=")
+	if eq <= 0 {
+		return PatternWeight{}, errors.New("weight should be in form 'regexp=weight'")
+	}
+
+	re, err := regexp.Compile(s[:eq])
+	if err != nil {
+		return PatternWeight{}, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	w, err := strconv.ParseFloat(s[eq+1:], 64)
+	if err != nil {
+		return PatternWeight{}, fmt.Errorf("invalid weight: %v", err)
+	}
+
+	return PatternWeight{Pattern: re, Weight: w}, nil
+}
+
+// WithPatternWeights sets weights used by OrderPriority
+func WithPatternWeights(weights []PatternWeight) Option {
+	return func(d *Downloader) {
+		d.weights = weights
+	}
+}
+
+// frontierItem is a page or a file waiting to be downloaded
+type frontierItem struct {
+	URL      string
+	Depth    int
+	Priority float64 `yaml:",omitempty" json:",omitempty"`
+	File     bool    `yaml:",omitempty" json:",omitempty"`
+	Referer  string  `yaml:",omitempty" json:",omitempty"` // page linking to the file
+}
+
+func (item frontierItem) kind() string {
+	if item.File {
+		return KindFile
+	}
+
+	return KindPage
+}
+
+// ordering keeps pending items in crawl order.
+// It's not safe for concurrent use.
+type ordering interface {
+	push(item frontierItem)
+	pop() (frontierItem, bool)
+	len() int
+
+	// items returns pending items in the order they would be popped
+	items() []frontierItem
+}
+
+// newOrdering creates ordering which keeps up to memLimit items
+// in memory and spills the rest to store. Zero memLimit means no limit.
+func newOrdering(o CrawlOrder, memLimit int, store *spillStore) ordering {
+	chunk := memLimit / 2
+	if chunk == 0 {
+		chunk = 1
+	}
+
+	switch o {
+	case OrderDFS:
+		return &stackOrdering{limit: memLimit, chunk: chunk, store: store}
+	case OrderPriority:
+		return &priorityOrdering{limit: memLimit, chunk: chunk, store: store}
+	}
+
+	return &queueOrdering{limit: memLimit, chunk: chunk, store: store}
+}
+
+// queue gives out pages and files to download
+type queue interface {
+	push(item frontierItem)
+
+	// next returns next item to download and marks it in flight.
+	// If there are no items, done is true when nothing is in flight,
+	// so no new items will appear.
+	next() (item frontierItem, ok bool, done bool)
+
+	// finish marks item returned by next as processed.
+	// Interrupted item is given out again later.
+	finish(item frontierItem, interrupted bool)
+
+	// wait returns channel which is ready when next should be tried again
+	wait() <-chan struct{}
+
+	// empty returns true if nothing is queued or in flight
+	empty() bool
+
+	// stats returns number of queued items and items in flight
+	stats() (int, int)
+
+	// items returns pending pages to be saved in state
+	items() []frontierItem
+}
+
+// frontier is a set of pages and files waiting to be downloaded.
+// It also tracks items which are being downloaded
+// to find out when crawling is finished.
+type frontier struct {
+	lock        sync.Mutex
+	pages       ordering
+	files       ordering
+	inflight    []frontierItem // saved in state until they are finished
+	interrupted []frontierItem // given out again by the next run
+	ready       chan struct{}  // signals about new items or finished ones
+}
+
+func newFrontier(o CrawlOrder, memLimit int, spillDir string) *frontier {
+	f := &frontier{
+		ready: make(chan struct{}, 1),
+	}
+
+	var pagesStore, filesStore *spillStore
+	if memLimit > 0 {
+		pagesStore = newSpillStore(spillDir, "pages")
+		filesStore = newSpillStore(spillDir, "files")
+	}
+
+	f.pages = newOrdering(o, memLimit, pagesStore)
+	f.files = newOrdering(OrderBFS, memLimit, filesStore)
+
+	return f
+}
+
+func (f *frontier) push(item frontierItem) {
+	f.lock.Lock()
+	if item.File {
+		f.files.push(item)
+	} else {
+		f.pages.push(item)
+	}
+	f.lock.Unlock()
+
+	f.notify()
+}
+
+// next returns next item to download.
+// Files go first as they don't bring new items.
+func (f *frontier) next() (item frontierItem, ok bool, done bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	item, ok = f.files.pop()
+	if !ok {
+		item, ok = f.pages.pop()
+	}
+
+	if ok {
+		f.inflight = append(f.inflight, item)
+		if f.files.len()+f.pages.len() > 0 {
+			// waking up next idle worker
+			f.notify()
+		}
+		return item, true, false
+	}
+
+	done = len(f.inflight) == 0
+	if done {
+		// letting other workers know
+		f.notify()
+	}
+
+	return item, false, done
+}
+
+// finish marks item as processed, interrupted items
+// are kept in state to be restored by the next run
+func (f *frontier) finish(item frontierItem, interrupted bool) {
+	f.lock.Lock()
+	for i, it := range f.inflight {
+		if it.URL == item.URL && it.File == item.File {
+			f.inflight = append(f.inflight[:i], f.inflight[i+1:]...)
+			break
+		}
+	}
+	if interrupted {
+		f.interrupted = append(f.interrupted, item)
+	}
+	f.lock.Unlock()
+
+	f.notify()
+}
+
+func (f *frontier) notify() {
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *frontier) wait() <-chan struct{} {
+	return f.ready
+}
+
+func (f *frontier) empty() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.inflight)+len(f.interrupted) == 0 && f.pages.len()+f.files.len() == 0
+}
+
+func (f *frontier) stats() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.pages.len() + f.files.len() + len(f.interrupted), len(f.inflight)
+}
+
+// items returns pending pages in crawl order followed by files,
+// items in flight or interrupted go first
+func (f *frontier) items() []frontierItem {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var pages, files []frontierItem
+	for _, items := range [][]frontierItem{f.interrupted, f.inflight} {
+		for _, item := range items {
+			if item.File {
+				files = append(files, item)
+			} else {
+				pages = append(pages, item)
+			}
+		}
+	}
+
+	pages = append(pages, f.pages.items()...)
+	files = append(files, f.files.items()...)
+
+	return append(pages, files...)
+}
+
+// spill writes items to the store.
+// Items are kept in memory if store fails.
+func spill(store *spillStore, items []frontierItem) bool {
+	err := store.write(items)
+	if err != nil {
+		log.Printf("ERR: failed to spill queue to disk: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// queueOrdering is FIFO. When it's full, new items are collected
+// in tail and written to disk by chunks.
+type queueOrdering struct {
+	head  []frontierItem
+	tail  []frontierItem
+	limit int
+	chunk int
+	store *spillStore
+}
+
+func (o *queueOrdering) push(item frontierItem) {
+	if o.limit == 0 || (o.store.empty() && len(o.tail) == 0 && len(o.head) < o.limit) {
+		o.head = append(o.head, item)
+		return
+	}
+
+	o.tail = append(o.tail, item)
+	if len(o.tail) >= o.chunk && spill(o.store, o.tail) {
+		o.tail = nil
+	}
+}
+
+func (o *queueOrdering) pop() (frontierItem, bool) {
+	if len(o.head) == 0 {
+		o.refill()
+	}
+	if len(o.head) == 0 {
+		return frontierItem{}, false
+	}
+
+	item := o.head[0]
+	o.head[0] = frontierItem{}
+	o.head = o.head[1:]
+
+	return item, true
+}
+
+func (o *queueOrdering) refill() {
+	if o.store != nil && !o.store.empty() {
+		items, err := o.store.readFirst()
+		if err != nil {
+			log.Printf("ERR: failed to read queue from disk: %v", err)
+		}
+		o.head = items
+		return
+	}
+
+	o.head, o.tail = o.tail, nil
+}
+
+func (o *queueOrdering) len() int {
+	n := len(o.head) + len(o.tail)
+	if o.store != nil {
+		n += o.store.count
+	}
+
+	return n
+}
+
+func (o *queueOrdering) items() []frontierItem {
+	res := append([]frontierItem(nil), o.head...)
+	if o.store != nil {
+		for i := range o.store.chunks {
+			res = append(res, o.store.chunk(i)...)
+		}
+	}
+
+	return append(res, o.tail...)
+}
+
+// stackOrdering is LIFO. When it's full, the oldest items
+// are written to disk and read back when memory is empty.
+type stackOrdering struct {
+	stack []frontierItem
+	limit int
+	chunk int
+	store *spillStore
+}
+
+func (o *stackOrdering) push(item frontierItem) {
+	o.stack = append(o.stack, item)
+
+	if o.limit > 0 && len(o.stack) > o.limit && spill(o.store, o.stack[:o.chunk]) {
+		o.stack = append([]frontierItem(nil), o.stack[o.chunk:]...)
+	}
+}
+
+func (o *stackOrdering) pop() (frontierItem, bool) {
+	if len(o.stack) == 0 && o.store != nil && !o.store.empty() {
+		items, err := o.store.readLast()
+		if err != nil {
+			log.Printf("ERR: failed to read queue from disk: %v", err)
+		}
+		o.stack = items
+	}
+	if len(o.stack) == 0 {
+		return frontierItem{}, false
+	}
+
+	item := o.stack[len(o.stack)-1]
+	o.stack = o.stack[:len(o.stack)-1]
+
+	return item, true
+}
+
+func (o *stackOrdering) len() int {
+	n := len(o.stack)
+	if o.store != nil {
+		n += o.store.count
+	}
+
+	return n
+}
+
+func (o *stackOrdering) items() []frontierItem {
+	res := make([]frontierItem, 0, o.len())
+	res = appendReversed(res, o.stack)
+	if o.store != nil {
+		for i := len(o.store.chunks) - 1; i >= 0; i-- {
+			res = appendReversed(res, o.store.chunk(i))
+		}
+	}
+
+	return res
+}
+
+func appendReversed(res, items []frontierItem) []frontierItem {
+	for i := len(items) - 1; i >= 0; i-- {
+		res = append(res, items[i])
+	}
+
+	return res
+}
+
+// priorityOrdering pops items with higher priority first,
+// then items with lower depth, then older items.
+// When it's full, leaves of the heap are written to disk
+// and merged back when the heap runs low,
+// so the order of spilled items is approximate.
+type priorityOrdering struct {
+	heap  itemHeap
+	seq   int
+	limit int
+	chunk int
+	store *spillStore
+}
+
+func (o *priorityOrdering) push(item frontierItem) {
+	o.seq++
+	heap.Push(&o.heap, seqItem{item: item, seq: o.seq})
+
+	if o.limit == 0 || len(o.heap) <= o.limit {
+		return
+	}
+
+	// removing from the end keeps heap valid
+	leaves := o.heap[len(o.heap)-o.chunk:]
+	items := make([]frontierItem, 0, len(leaves))
+	for _, l := range leaves {
+		items = append(items, l.item)
+	}
+	if spill(o.store, items) {
+		o.heap = o.heap[:len(o.heap)-o.chunk]
+	}
+}
+
+func (o *priorityOrdering) pop() (frontierItem, bool) {
+	if o.store != nil && !o.store.empty() && len(o.heap) < o.chunk {
+		items, err := o.store.readLast()
+		if err != nil {
+			log.Printf("ERR: failed to read queue from disk: %v", err)
+		}
+		for _, item := range items {
+			o.seq++
+			heap.Push(&o.heap, seqItem{item: item, seq: o.seq})
+		}
+	}
+	if len(o.heap) == 0 {
+		return frontierItem{}, false
+	}
+
+	return heap.Pop(&o.heap).(seqItem).item, true
+}
+
+func (o *priorityOrdering) len() int {
+	n := len(o.heap)
+	if o.store != nil {
+		n += o.store.count
+	}
+
+	return n
+}
+
+func (o *priorityOrdering) items() []frontierItem {
+	h := append(itemHeap(nil), o.heap...)
+	if o.store != nil {
+		for i := range o.store.chunks {
+			for _, item := range o.store.chunk(i) {
+				h = append(h, seqItem{item: item, seq: o.seq + i + 1})
+			}
+		}
+		heap.Init(&h)
+	}
+
+	res := make([]frontierItem, 0, len(h))
+	for len(h) > 0 {
+		res = append(res, heap.Pop(&h).(seqItem).item)
+	}
+
+	return res
+}
+
+type seqItem struct {
+	item frontierItem
+	seq  int
+}
+
+type itemHeap []seqItem
+
+func (h itemHeap) Len() int { return len(h) }
+
+func (h itemHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	if a.item.Priority != b.item.Priority {
+		return a.item.Priority > b.item.Priority
+	}
+	if a.item.Depth != b.item.Depth {
+		return a.item.Depth < b.item.Depth
+	}
+
+	return a.seq < b.seq
+}
+
+func (h itemHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *itemHeap) Push(x interface{}) { *h = append(*h, x.(seqItem)) }
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
+
+// restoreFrontier queues pages and files from the state
+// so they are crawled in the same order as before the stop
+func (d *Downloader) restoreFrontier() {
+	var pages, files []frontierItem
+	for _, item := range d.restoredItems {
+		if item.File {
+			files = append(files, item)
+		} else {
+			pages = append(pages, item)
+		}
+	}
+	items := pages
+
+	// pages which were in flight when state of older versions
+	// was saved or pending pages without frontier go first
+	inflight := make([]frontierItem, 0, len(d.restoredURLs))
+	for _, u := range d.restoredURLs {
+		inflight = append(inflight, frontierItem{URL: u.String()})
+	}
+
+	if d.order == OrderDFS {
+		// stack pops in reverse order of pushes
+		items = make([]frontierItem, 0, len(pages)+len(inflight))
+		for i := len(pages) - 1; i >= 0; i-- {
+			items = append(items, pages[i])
+		}
+		items = append(items, inflight...)
+	} else {
+		items = append(inflight, items...)
+	}
+
+	for _, item := range items {
+		d.restoreItem(item)
+	}
+
+	for _, item := range files {
+		d.frontier.push(item)
+	}
+	for _, u := range d.restoredFiles {
+		d.restoreFile(u)
+	}
+}
+
+// priority calculates priority of the url for OrderPriority
+func (d *Downloader) priority(link string) float64 {
+	var p float64
+	for _, w := range d.weights {
+		if w.Pattern.MatchString(link) {
+			p += w.Weight
+		}
+	}
+
+	if d.sitemap != nil {
+		p += d.sitemap[link]
+	}
+
+	return p
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DefaultUserAgent is sent when no User-Agent is configured
+const DefaultUserAgent = "tegw/1.0 (+https://github.com/scukonick/tegw)"
+
+// WithUserAgent sets User-Agent header for all requests
+func WithUserAgent(ua string) Option {
+	return func(d *Downloader) {
+		d.headers.Set("User-Agent", ua)
+	}
+}
+
+// WithAcceptLanguage sets Accept-Language header for all requests
+func WithAcceptLanguage(lang string) Option {
+	return func(d *Downloader) {
+		d.headers.Set("Accept-Language", lang)
+	}
+}
+
+// WithHeader adds header to all requests
+func WithHeader(name, value string) Option {
+	return func(d *Downloader) {
+		d.headers.Set(name, value)
+	}
+}
+
+// WithHostHeader adds header to requests to the host only.
+// It overrides header with the same name set by WithHeader.
+func WithHostHeader(host, name, value string) Option {
+	return func(d *Downloader) {
+		host = strings.ToLower(host)
+
+		h, ok := d.hostHeaders[host]
+		if !ok {
+			h = make(http.Header)
+			d.hostHeaders[host] = h
+		}
+		h.Set(name, value)
+	}
+}
+
+// ParseHeader parses header in form "Name: value"
+func ParseHeader(s string) (string, string, error) {
+	colon := strings.Index(s, ":")
+	if colon <= 0 {
+		return "", "", errors.New("header should be in form 'Name: value'")
+	}
+
+	return strings.TrimSpace(s[:colon]), strings.TrimSpace(s[colon+1:]), nil
+}
+
+// ParseHostHeader parses header in form "host=Name: value"
+func ParseHostHeader(s string) (string, string, string, error) {
+	eq := strings.Index(s, "=")
+	if eq <= 0 {
+		return "", "", "", errors.New("host header should be in form 'host=Name: value'")
+	}
+
+	name, value, err := ParseHeader(s[eq+1:])
+
+	return s[:eq], name, value, err
+}
+
+// applyHeaders sets common headers and headers of the request's host
+func (d *Downloader) applyHeaders(req *http.Request) {
+	for k, v := range d.headers {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	h, ok := d.hostHeaders[strings.ToLower(req.URL.Host)]
+	if !ok {
+		h, ok = d.hostHeaders[strings.ToLower(req.URL.Hostname())]
+	}
+	if !ok {
+		return
+	}
+
+	for k, v := range h {
+		req.Header[k] = append([]string(nil), v...)
+	}
+}
+
+// removeHostHeaders removes headers which could be set
+// by applyHeaders for any host
+func (d *Downloader) removeHostHeaders(req *http.Request) {
+	for _, h := range d.hostHeaders {
+		for k := range h {
+			req.Header.Del(k)
+		}
+	}
+}
@@ -26,5 +26,21 @@ func (d *Downloader) buildRequest(ctx context.Context, link string) *http.Reques
 	ctx, _ = context.WithTimeout(ctx, d.timeout)
 	req = req.WithContext(ctx)
 
+	d.applyHeaders(req)
+	d.applyCredentials(req)
+
 	return req
 }
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"log"
+)
+
+// WithMaxFileSize limits size of downloaded text files in bytes.
+// Larger files are not stored and recorded as skipped.
+func WithMaxFileSize(size int64) Option {
+	return func(d *Downloader) {
+		d.maxFileSize = size
+	}
+}
+
+// WithMaxPageSize limits size of html pages read for links in bytes.
+// Larger pages are not parsed and recorded as skipped.
+func WithMaxPageSize(size int64) Option {
+	return func(d *Downloader) {
+		d.maxPageSize = size
+	}
+}
+
+// WithMaxDepth limits number of links from the input url to crawled
+// pages and files, links of pages at maxDepth are not followed.
+func WithMaxDepth(depth int) Option {
+	return func(d *Downloader) {
+		d.maxDepth = depth
+	}
+}
+
+func tooLarge(size, limit int64) string {
+	return fmt.Sprintf("size %d exceeds limit %d", size, limit)
+}
+
+// skipFile marks file as processed without storing it
+func (d *Downloader) skipFile(input string, code int, reason string) {
+	log.Printf("SKIP %s: %s", input, reason)
+
+	d.filesLock.Lock()
+	r := d.fileRecord(input)
+	r.Code = code
+	r.Error = reason
+	d.doneFile(input, StatusSkipped)
+	d.filesLock.Unlock()
+}
+
+// filterFile marks file rejected by filter as processed
+func (d *Downloader) filterFile(input string, code int, reason string) {
+	log.Printf("FILTER %s: %s", input, reason)
+
+	d.filesLock.Lock()
+	r := d.fileRecord(input)
+	r.Code = code
+	r.Error = reason
+	d.doneFile(input, StatusFiltered)
+	d.filesLock.Unlock()
+}
+
+// skipURL marks page as processed without parsing it
+func (d *Downloader) skipURL(input string, code int, reason string) {
+	log.Printf("SKIP %s: %s", input, reason)
+
+	d.urlsLock.Lock()
+	r := d.urlRecord(input)
+	r.Code = code
+	r.Error = reason
+	d.doneURL(input, StatusSkipped)
+	d.urlsLock.Unlock()
+}
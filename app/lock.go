@@ -0,0 +1,179 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// lockFile is name of the lock file in stateDir
+const lockFile = "tegw.lock"
+
+// lockPoll is how often lock is checked while waiting for it
+var lockPoll = time.Second
+
+// Lock prevents several processes from using the same stateDir.
+// Lock file is locked by OS while it's open, so lock of process
+// which died is released without any cleanup.
+type Lock struct {
+	filename string
+	f        *os.File
+	owner    LockOwner
+}
+
+// LockOwner is process holding the lock
+type LockOwner struct {
+	PID      int       `yaml:"pid"`
+	Hostname string    `yaml:"hostname"`
+	Started  time.Time `yaml:"started"`
+}
+
+func (o LockOwner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", o.PID, o.Hostname, o.Started.Format(time.RFC3339))
+}
+
+// ErrLocked is returned by AcquireLock if stateDir is used by another process
+type ErrLocked struct {
+	Owner LockOwner
+}
+
+func (e *ErrLocked) Error() string {
+	return fmt.Sprintf("state is locked by %s, "+
+		"use -force if this process does not exist anymore", e.Owner)
+}
+
+// AcquireLock takes exclusive lock of stateDir.
+// If it's held by another process, lock is awaited for up to wait.
+// With force lock is taken over, e.g. from a process on another host
+// which could not release it.
+func AcquireLock(stateDir string, wait time.Duration, force bool) (*Lock, error) {
+	err := os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	l := &Lock{
+		filename: path.Join(stateDir, lockFile),
+		owner:    LockOwner{PID: os.Getpid(), Hostname: hostname, Started: time.Now()},
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := l.tryLock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock: %v", err)
+		}
+		if ok {
+			return l, l.writeOwner()
+		}
+
+		owner, err := readLock(l.filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read lock: %v", err)
+		}
+
+		switch {
+		case force:
+			// holder keeps lock of removed file
+			log.Printf("WARN: taking over state lock of %s", owner)
+			err = os.Remove(l.filename)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			force = false
+		case time.Now().Before(deadline):
+			time.Sleep(lockPoll)
+		default:
+			return nil, &ErrLocked{Owner: owner}
+		}
+	}
+}
+
+// tryLock locks lock file, false is returned if it's locked by
+// another process. Lock file could be removed by takeover after
+// it was opened, then it's opened again.
+func (l *Lock) tryLock() (bool, error) {
+	for {
+		f, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := tryLockFile(f)
+		if err != nil || !ok {
+			closeC(f)
+			return false, err
+		}
+
+		opened, err := f.Stat()
+		if err != nil {
+			closeC(f)
+			return false, err
+		}
+		current, err := os.Stat(l.filename)
+		if err == nil && os.SameFile(opened, current) {
+			l.f = f
+			return true, nil
+		}
+		closeC(f)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+}
+
+// writeOwner writes owner to locked file, so it's
+// reported to other processes waiting for the lock
+func (l *Lock) writeOwner() error {
+	data, err := yaml.Marshal(l.owner)
+	if err != nil {
+		return err
+	}
+
+	err = l.f.Truncate(0)
+	if err == nil {
+		_, err = l.f.WriteAt(data, 0)
+	}
+	if err != nil {
+		closeC(l.f)
+		return err
+	}
+
+	return nil
+}
+
+// Release unlocks lock file. It's kept, as removing it would
+// let another process lock the removed file while the next
+// one creates a new file.
+func (l *Lock) Release() error {
+	err := l.f.Truncate(0)
+	if err != nil {
+		closeC(l.f)
+		return err
+	}
+
+	return l.f.Close()
+}
+
+func readLock(filename string) (LockOwner, error) {
+	owner := LockOwner{}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return owner, err
+	}
+
+	// owner is not known if lock is being written
+	err = yaml.Unmarshal(data, &owner)
+	if err != nil {
+		return LockOwner{}, nil
+	}
+
+	return owner, nil
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tegw-lock-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lock file left by a process which died is not locked
+	err = ioutil.WriteFile(path.Join(dir, lockFile), []byte("pid: 1\nhostname: x\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := AcquireLock(dir, 0, false)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	_, err = AcquireLock(dir, 0, false)
+	locked, ok := err.(*ErrLocked)
+	if !ok || locked.Owner.PID != os.Getpid() {
+		t.Fatalf("second lock: %v", err)
+	}
+
+	err = a.Release()
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	b, err := AcquireLock(dir, 0, false)
+	if err != nil {
+		t.Fatalf("acquire released lock: %v", err)
+	}
+
+	// b can't release lock taken over by c
+	c, err := AcquireLock(dir, 0, true)
+	if err != nil {
+		t.Fatalf("take over: %v", err)
+	}
+	_, err = AcquireLock(dir, 0, false)
+	if _, ok := err.(*ErrLocked); !ok {
+		t.Fatalf("lock after take over: %v", err)
+	}
+	_ = b.Release()
+	_, err = AcquireLock(dir, 0, false)
+	if _, ok := err.(*ErrLocked); !ok {
+		t.Fatalf("lock after release of taken over lock: %v", err)
+	}
+	_ = c.Release()
+}
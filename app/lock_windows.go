@@ -0,0 +1,33 @@
+package app
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// tryLockFile takes exclusive lock of f without waiting,
+// false is returned if it's locked by another process.
+// Locked byte is far beyond the content, so it can be read.
+func tryLockFile(f *os.File) (bool, error) {
+	ol := syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately,
+		0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errLockViolation || err == syscall.ERROR_IO_PENDING {
+		return false, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// metaExt is added to name of the file for its metadata file
+const metaExt = ".meta.json"
+
+// WithMeta makes Downloader write '<name>.meta.json' with metadata of
+// every stored file next to it in the sink, or to dir on local
+// filesystem if dir is not empty
+func WithMeta(dir string) Option {
+	return func(d *Downloader) {
+		d.meta = true
+		if dir != "" {
+			d.metaSink = NewFSSink(dir)
+		}
+	}
+}
+
+// fileMeta allows to trace stored file back to its source
+type fileMeta struct {
+	URL       string      `json:"url"`
+	FinalURL  string      `json:"final_url"` // after redirects
+	Referer   string      `json:"referer,omitempty"`
+	Status    int         `json:"status"`
+	Headers   http.Header `json:"headers"`
+	Requested time.Time   `json:"requested"`
+	Completed time.Time   `json:"completed"`
+	Size      int64       `json:"size"`
+	SHA256    string      `json:"sha256,omitempty"` // not known for some resumed downloads
+	Charset   string      `json:"charset,omitempty"`
+	Resumed   bool        `json:"resumed,omitempty"`
+}
+
+// writeMeta stores metadata of file stored as name.
+// File is stored already, so errors are only logged.
+func (d *Downloader) writeMeta(name string, m *fileMeta) {
+	sink := d.metaSink
+	if sink == nil {
+		sink = d.sink
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Printf("ERR: failed to marshal metadata of %s: %v", m.URL, err)
+		return
+	}
+	data = append(data, '\n')
+
+	f, err := sink.Create(name + metaExt)
+	if err != nil {
+		log.Printf("ERR: failed to write metadata of %s: %v", m.URL, err)
+		return
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		abortC(f)
+		log.Printf("ERR: failed to write metadata of %s: %v", m.URL, err)
+		return
+	}
+
+	err = f.Commit()
+	if err != nil {
+		log.Printf("ERR: failed to write metadata of %s: %v", m.URL, err)
+	}
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// stateVersion is version of state file layout written by this code.
+// Version 1 had no version field, boolean entries
+// and separate maps of skipped urls and partial downloads.
+const stateVersion = 2
+
+// migrations upgrade state of version i+1 to version i+2
+var migrations = []func(s *state) error{
+	migrateRecords,
+}
+
+// upgrade migrates state read from file to the current version
+func (s *state) upgrade() error {
+	if s.Version == 0 {
+		s.Version = 1
+	}
+	if s.Version < stateVersion {
+		s.upgradedFrom = s.Version
+	}
+
+	for s.Version < stateVersion {
+		err := migrations[s.Version-1](s)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade state from version %d: %v", s.Version, err)
+		}
+		s.Version++
+	}
+
+	if s.URLs == nil {
+		s.URLs = make(map[string]*record)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*record)
+	}
+	for _, records := range []map[string]*record{s.URLs, s.Files} {
+		for link, r := range records {
+			if r == nil {
+				records[link] = newRecord()
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateRecords moves skipped urls and partial downloads to records.
+// Boolean entries are loaded as records by record.UnmarshalYAML.
+func migrateRecords(s *state) error {
+	if s.URLs == nil {
+		s.URLs = make(map[string]*record)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*record)
+	}
+
+	for link, reason := range s.SkippedURLs {
+		r := s.URLs[link]
+		if r == nil {
+			r = newRecord()
+			s.URLs[link] = r
+		}
+		r.Status = StatusSkipped
+		r.Error = reason
+	}
+	for link, reason := range s.SkippedFiles {
+		r := s.Files[link]
+		if r == nil {
+			r = newRecord()
+			s.Files[link] = r
+		}
+		r.Status = StatusSkipped
+		r.Error = reason
+	}
+	for link, p := range s.Partials {
+		r := s.Files[link]
+		if r == nil {
+			r = newRecord()
+			s.Files[link] = r
+		}
+		p := p
+		r.Partial = &p
+	}
+
+	s.SkippedURLs = nil
+	s.SkippedFiles = nil
+	s.Partials = nil
+
+	return nil
+}
+
+// backupState keeps copy of state file which was upgraded on load
+// before it's overwritten in the new format, e.g. state.yaml.v1.bak
+func backupState(filename string, s *state) error {
+	if s.upgradedFrom == 0 {
+		return nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", filename, s.upgradedFrom)
+	if _, err := os.Stat(backup); err == nil {
+		// keeping the oldest backup
+		return nil
+	}
+
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer closeC(src)
+
+	dst, err := os.OpenFile(backup, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to backup state: %v", err)
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		closeC(dst)
+		cleanTmp(backup)
+		return fmt.Errorf("failed to backup state: %v", err)
+	}
+
+	err = dst.Close()
+	if err != nil {
+		cleanTmp(backup)
+		return fmt.Errorf("failed to backup state: %v", err)
+	}
+
+	log.Printf("state upgraded from version %d to %d, old state is saved to %s",
+		s.upgradedFrom, stateVersion, backup)
+
+	return nil
+}
@@ -1,8 +1,10 @@
 package app
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"strings"
@@ -12,124 +14,150 @@ import (
 	"golang.org/x/net/context"
 )
 
-func (d *Downloader) processNewURLsV2(ctx context.Context) chan *url.URL {
-	c := make(chan interface{})
-
-	filesCh := make(chan *url.URL)
-
-	for _, u := range d.restoredFiles {
-		d.urlsWG.Add(1)
-		go func() {
-			d.addFile(ctx, u, filesCh)
-			d.urlsWG.Done()
-		}()
-	}
-
-	go func() {
-		for {
-			select {
-			case <-d.ctx.Done():
-				return
-			case u := <-d.urlsCh:
-				go func() {
-					d.processNewURLV2(ctx, u, filesCh)
-					d.urlsWG.Done()
-				}()
-			case <-c:
-				return
-			}
-		}
-	}()
-
-	go func() {
-		d.urlsWG.Wait()
-		close(c)
-		close(filesCh)
-	}()
-
-	return filesCh
+// addURL should be used instead direct push to the frontier
+// in order to crawl every page only once
+func (d *Downloader) addURL(u *url.URL, depth int) {
+	d.addItem(frontierItem{URL: u.String(), Depth: depth})
 }
 
-// addURL should be used instead direct write to channel
-// in order to ube able to manage processNewURL goroutines
-func (d *Downloader) addURL(ctx context.Context, u *url.URL) {
-	input := u.String()
-
+func (d *Downloader) addItem(item frontierItem) {
 	d.urlsLock.Lock()
 
 	// check if url was not processed
-	if _, ok := d.urls[input]; ok {
+	if d.seenURL(item.URL) {
 		d.urlsLock.Unlock()
 		return
 	}
 
-	d.urls[input] = false
+	if d.seen == nil {
+		// with disk seen set or shared store pending pages
+		// are kept only in the frontier
+		d.urls[item.URL] = newRecord()
+	}
 	d.urlsLock.Unlock()
 
-	d.urlsWG.Add(1)
-
-	go func() {
-		select {
-		case d.urlsCh <- u:
-		case <-ctx.Done():
-			d.urlsWG.Done()
+	if d.retryOnly {
+		// crawled by the next run
+		if d.order == OrderPriority {
+			item.Priority = d.priority(item.URL)
 		}
-	}()
+		d.keptLock.Lock()
+		d.kept = append(d.kept, item)
+		d.keptLock.Unlock()
+		return
+	}
+
+	d.queueItem(item)
 }
 
-func (d *Downloader) processNewURLV2(ctx context.Context, u *url.URL, filesCh chan *url.URL) {
-	input := u.String()
+// restoreItem queues pending page from the state.
+// Its record is already loaded from the state.
+func (d *Downloader) restoreItem(item frontierItem) {
+	if d.seen == nil {
+		d.urlsLock.Lock()
+		d.urlRecord(item.URL)
+		d.urlsLock.Unlock()
+	}
 
-	select {
-	case <-ctx.Done():
-		return
-	case <-d.limiter:
+	d.queueItem(item)
+}
+
+func (d *Downloader) queueItem(item frontierItem) {
+	if d.order == OrderPriority {
+		item.Priority = d.priority(item.URL)
 	}
+	d.frontier.push(item)
+}
+
+func (d *Downloader) processNewURLV2(ctx context.Context, item frontierItem) {
+	input := item.URL
 
 	log.Printf("GET %s", input)
+	d.attemptURL(input)
 	now := time.Now()
 	req := d.buildRequest(ctx, input)
 	resp, err := d.client.Do(req)
 	log.Printf("Done %s, took: %v", input, time.Since(now))
 
-	d.limiter <- true
 	if err != nil {
-		log.Printf("ERR: failed to download url %s: %v", input, err)
+		d.failURL(ctx, input, 0, err)
 		return
 	}
 	defer closeC(resp.Body)
 
 	if resp.StatusCode != 200 {
-		log.Printf("ERR: failed to download url %s: http %d", input, resp.StatusCode)
+		d.failURL(ctx, input, resp.StatusCode, fmt.Errorf("http %d", resp.StatusCode))
 		return
 	}
 
 	contentType := resp.Header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "text/html") {
-		log.Printf("ERR: failed to download url %s: invalid content type: %s",
-			input, contentType)
+		d.skipURL(input, resp.StatusCode, "invalid content type: "+contentType)
 		return
 	}
 
-	urls, files, err := d.parseResp(resp.Body)
+	if d.maxPageSize > 0 && resp.ContentLength > d.maxPageSize {
+		d.skipURL(input, resp.StatusCode, tooLarge(resp.ContentLength, d.maxPageSize))
+		return
+	}
+
+	body := &countingReader{r: resp.Body}
+	if d.maxPageSize > 0 {
+		// reading one more byte to find out if page is larger than limit
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, d.maxPageSize+1))
+		if err != nil {
+			d.failURL(ctx, input, resp.StatusCode, err)
+			return
+		}
+		if int64(len(data)) > d.maxPageSize {
+			d.skipURL(input, resp.StatusCode, tooLarge(int64(len(data)), d.maxPageSize))
+			return
+		}
+		body.r = bytes.NewReader(data)
+	}
+
+	var page io.Reader = body
+	var charset string
+	if d.charset != CharsetIgnore {
+		// links are extracted from UTF-8, rendered pages should be UTF-8 too
+		page, charset = decodeText(input, contentType, body, true, true)
+	}
+
+	page, err = d.renderer.Render(ctx, resp.Request.URL, page)
+	if err != nil {
+		d.failURL(ctx, input, resp.StatusCode, err)
+		return
+	}
+
+	urls, files, err := d.parseResp(page)
 	if err != nil {
-		log.Printf("ERR: failed to download url %s: %v", input, err)
+		d.failURL(ctx, input, resp.StatusCode, err)
 		return
 	}
 
+	if d.maxDepth > 0 && item.Depth >= d.maxDepth {
+		// links are not followed, but page is parsed to check it
+		urls, files = nil, nil
+	}
+
 	// using resp.RequestURL to handle relative URLs after redirects
 	urls = d.filterURLs(resp.Request.URL, urls)
 	for _, v := range urls {
-		d.addURL(ctx, v)
+		d.addURL(v, item.Depth+1)
 	}
 
 	for _, v := range files {
 		// not checking files url domain, only replace relative urls
-		d.addFile(ctx, resp.Request.URL.ResolveReference(v), filesCh)
+		d.addFile(resp.Request.URL.ResolveReference(v), item.Depth+1, resp.Request.URL.String())
 	}
 
 	d.urlsLock.Lock()
-	d.urls[input] = true
+	r := d.urlRecord(input)
+	r.Code = resp.StatusCode
+	r.Error = ""
+	r.Size = body.n
+	r.Charset = charset
+	d.doneURL(input, StatusDone)
 	d.urlsLock.Unlock()
 }
 
@@ -145,6 +173,7 @@ func (d *Downloader) filterURLs(referer *url.URL, urls []*url.URL) []*url.URL {
 
 		err := d.checkURL(u)
 		if err != nil {
+			d.outOfScope(u.String(), err)
 			continue
 		}
 		filteredURLs = append(filteredURLs, u)
@@ -153,30 +182,24 @@ func (d *Downloader) filterURLs(referer *url.URL, urls []*url.URL) []*url.URL {
 	return filteredURLs
 }
 
-// checkURL checks if input URL has the same domain
-// as baseURL and it's path contains path of baseURL.
-// It does not check if the scheme is different.
-func (d *Downloader) checkURL(u *url.URL) error {
-	if d.baseURL.Host != u.Host {
-		return errors.New("invalid host")
-	}
-
-	basePath := d.baseURL.Path
-	newPath := u.Path
+// outOfScope records page which is not crawled because of its url
+func (d *Downloader) outOfScope(link string, err error) {
+	d.urlsLock.Lock()
+	defer d.urlsLock.Unlock()
 
-	if basePath == newPath {
-		return nil
+	if d.seenURL(link) {
+		return
 	}
 
-	if !strings.HasSuffix(basePath, "/") {
-		basePath += "/"
-	}
+	r := newRecord()
+	r.Status = StatusSkipped
+	r.Error = "out of scope: " + err.Error()
 
-	if !strings.HasPrefix(newPath, basePath) {
-		return errors.New("invalid path")
+	if d.seen != nil {
+		d.journal.write(KindPage, link, r)
+		return
 	}
-
-	return nil
+	d.urls[link] = r
 }
 
 // parseResp parses response body and returns
@@ -203,7 +226,7 @@ func (d *Downloader) parseResp(i io.Reader) ([]*url.URL, []*url.URL, error) {
 			return
 		}
 
-		if urlIsTextFile(u) {
+		if d.isTextFile(u) {
 			files = append(files, u)
 			return
 		}
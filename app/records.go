@@ -0,0 +1,317 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// statuses of pages and files in state
+const (
+	StatusPending  = "pending" // queued or not tried yet
+	StatusDone     = "done"
+	StatusFailed   = "failed"   // fetched again on the next run
+	StatusSkipped  = "skipped"  // not stored because of limits, content or scope
+	StatusFiltered = "filtered" // rejected by file filter
+)
+
+// record is state of a page or a file
+type record struct {
+	Status   string       `yaml:"status" json:"status"`
+	Code     int          `yaml:"code,omitempty" json:"code,omitempty"`   // http status code
+	Error    string       `yaml:"error,omitempty" json:"error,omitempty"` // why it failed or was skipped
+	Attempts int          `yaml:"attempts,omitempty" json:"attempts,omitempty"`
+	Added    time.Time    `yaml:"added,omitempty" json:"added"`
+	Fetched  time.Time    `yaml:"fetched,omitempty" json:"fetched"` // last attempt
+	Size     int64        `yaml:"size,omitempty" json:"size,omitempty"`
+	Output   string       `yaml:"output,omitempty" json:"output,omitempty"` // name in sink
+	SHA256   string       `yaml:"sha256,omitempty" json:"sha256,omitempty"` // of stored file
+	Charset  string       `yaml:"charset,omitempty" json:"charset,omitempty"`
+	Referer  string       `yaml:"referer,omitempty" json:"referer,omitempty"` // page linking to the file
+	Partial  *partialFile `yaml:"partial,omitempty" json:"-"`
+}
+
+func newRecord() *record {
+	return &record{Status: StatusPending, Added: time.Now()}
+}
+
+// UnmarshalYAML loads boolean entries of old state files as well
+func (r *record) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var processed bool
+	if unmarshal(&processed) == nil {
+		r.Status = StatusPending
+		if processed {
+			r.Status = StatusDone
+		}
+		return nil
+	}
+
+	type plain record
+	return unmarshal((*plain)(r))
+}
+
+// finished returns true if record should not be fetched again
+func (r *record) finished() bool {
+	return r.Status == StatusDone || r.Status == StatusSkipped || r.Status == StatusFiltered
+}
+
+// urlRecord returns record of the page.
+// It should be called with urlsLock held.
+func (d *Downloader) urlRecord(link string) *record {
+	r, ok := d.urls[link]
+	if !ok {
+		r = newRecord()
+		d.urls[link] = r
+	}
+
+	return r
+}
+
+// fileRecord is the same as urlRecord for files.
+// It should be called with filesLock held.
+func (d *Downloader) fileRecord(link string) *record {
+	r, ok := d.files[link]
+	if !ok {
+		r = newRecord()
+		d.files[link] = r
+	}
+
+	return r
+}
+
+// attemptURL records new attempt to fetch the page
+func (d *Downloader) attemptURL(link string) {
+	d.urlsLock.Lock()
+	r := d.urlRecord(link)
+	r.Attempts++
+	r.Fetched = time.Now()
+	d.urlsLock.Unlock()
+}
+
+// attemptFile records new attempt to download the file
+func (d *Downloader) attemptFile(link string) {
+	d.filesLock.Lock()
+	r := d.fileRecord(link)
+	r.Attempts++
+	r.Fetched = time.Now()
+	d.filesLock.Unlock()
+}
+
+// failURL records failed attempt, the page is fetched again on the next run.
+// Status is not changed if crawl was interrupted.
+func (d *Downloader) failURL(ctx context.Context, link string, code int, err error) {
+	log.Printf("ERR: failed to download url %s: %v", link, err)
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.urlsLock.Lock()
+	r := d.urlRecord(link)
+	r.Status = StatusFailed
+	r.Code = code
+	r.Error = err.Error()
+	if d.shared != nil {
+		// reporting to coordinator
+		d.journal.write(KindPage, link, r)
+		delete(d.urls, link)
+	}
+	d.urlsLock.Unlock()
+}
+
+// failFile is the same as failURL for files
+func (d *Downloader) failFile(ctx context.Context, link string, code int, err error) {
+	log.Printf("ERR: failed to download file %s: %v", link, err)
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.filesLock.Lock()
+	r := d.fileRecord(link)
+	r.Status = StatusFailed
+	r.Code = code
+	r.Error = err.Error()
+	if d.shared != nil {
+		d.journal.write(KindFile, link, r)
+		delete(d.files, link)
+	}
+	d.filesLock.Unlock()
+}
+
+// journalFile is name of the journal in stateDir
+const journalFile = "journal.jsonl"
+
+// journalEntry is a line of the journal
+type journalEntry struct {
+	Kind   string  `json:"kind"`
+	URL    string  `json:"url"`
+	Record *record `json:"record"`
+}
+
+// recordLog keeps records of processed pages and files
+// which are not kept in memory
+type recordLog interface {
+	write(kind, link string, r *record)
+
+	// reset removes all records
+	reset() error
+}
+
+// journal is recordLog in a file in stateDir
+type journal struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func openJournal(filename string) (*journal, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{f: f}, nil
+}
+
+// write appends record to the journal
+func (j *journal) write(kind, link string, r *record) {
+	data, err := json.Marshal(journalEntry{Kind: kind, URL: link, Record: r})
+	if err != nil {
+		log.Printf("ERR: failed to marshal record of %s: %v", link, err)
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, err = j.f.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("ERR: failed to write record of %s: %v", link, err)
+	}
+}
+
+// size returns size of the journal file
+func (j *journal) size() (int64, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	info, err := j.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// truncate drops records written after the journal had size bytes
+func (j *journal) truncate(size int64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	info, err := j.f.Stat()
+	if err != nil || info.Size() <= size {
+		return err
+	}
+
+	return j.f.Truncate(size)
+}
+
+// reset removes all records
+func (j *journal) reset() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.f.Truncate(0)
+}
+
+// readJournal calls fn for every record in journal file
+func readJournal(filename string, fn func(journalEntry)) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeC(f)
+
+	return scanJournal(f, fn)
+}
+
+func scanJournal(r io.Reader, fn func(journalEntry)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		e := journalEntry{}
+		err := json.Unmarshal(sc.Bytes(), &e)
+		if err != nil || e.Record == nil {
+			// line torn by crash
+			continue
+		}
+		fn(e)
+	}
+
+	return sc.Err()
+}
+
+// filterJournal removes records for which drop returns true from
+// journal file. Records after size bytes are dropped as well,
+// as they are not in the saved state. New size is returned.
+func filterJournal(filename string, size *int64, drop func(journalEntry) bool) (int64, error) {
+	src, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closeC(src)
+
+	var r io.Reader = src
+	if size != nil {
+		r = io.LimitReader(src, *size)
+	}
+
+	tmpPath := filename + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	w := bufio.NewWriter(dst)
+	var written int64
+	err = scanJournal(r, func(e journalEntry) {
+		if drop(e) {
+			return
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		n, _ := w.Write(append(data, '\n'))
+		written += int64(n)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		closeC(dst)
+		cleanTmp(tmpPath)
+		return 0, err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		cleanTmp(tmpPath)
+		return 0, err
+	}
+
+	return written, os.Rename(tmpPath, filename)
+}
@@ -0,0 +1,314 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisClient is a minimal client of Redis protocol (RESP2)
+// with a pool of connections. It's safe for concurrent use.
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// errRedisNil is returned by reply helpers for nil replies
+var errRedisNil = errors.New("redis: nil reply")
+
+// redisError is error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedisClient creates client of redis://[:password@]host[:port][/db].
+// Connections are established on demand.
+func NewRedisClient(rawURL string, timeout time.Duration) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, errors.New("redis url should look like redis://[:password@]host[:port][/db]")
+	}
+
+	c := &RedisClient{
+		addr:    u.Host,
+		timeout: timeout,
+		idle:    make(chan *redisConn, 16),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+
+	db := strings.Trim(u.Path, "/")
+	if db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db %q", db)
+		}
+	}
+
+	return c, nil
+}
+
+// Do sends command and returns its reply: string, int64,
+// nil or []interface{}. Error replies are returned as errors.
+func (c *RedisClient) Do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+
+	if e, ok := replies[0].(redisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands in one round trip and returns their replies.
+// Error replies are returned as redisError values.
+func (c *RedisClient) pipeline(cmds [][]string) ([]interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := rc.roundTrip(cmds, c.timeout)
+	if err != nil {
+		closeC(rc.conn)
+		return nil, err
+	}
+	c.put(rc)
+
+	return replies, nil
+}
+
+// replyError returns the first error reply of pipeline
+func replyError(replies []interface{}) error {
+	for _, reply := range replies {
+		if e, ok := reply.(redisError); ok {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Close closes idle connections
+func (c *RedisClient) Close() {
+	for {
+		select {
+		case rc := <-c.idle:
+			closeC(rc.conn)
+		default:
+			return
+		}
+	}
+}
+
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) == 0 {
+		return rc, nil
+	}
+
+	replies, err := rc.roundTrip(setup, c.timeout)
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		closeC(conn)
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func (c *RedisClient) put(rc *redisConn) {
+	select {
+	case c.idle <- rc:
+	default:
+		closeC(rc.conn)
+	}
+}
+
+func (rc *redisConn) roundTrip(cmds [][]string, timeout time.Duration) ([]interface{}, error) {
+	if timeout > 0 {
+		err := rc.conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, args := range cmds {
+		fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	err := rc.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		replies[i], err = readReply(rc.r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return replies, nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		res := make([]interface{}, n)
+		for i := range res {
+			res[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+// redisInt converts integer reply
+func redisInt(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case nil:
+		return 0, errRedisNil
+	}
+
+	return 0, fmt.Errorf("redis: unexpected reply %T", reply)
+}
+
+// redisString converts string reply
+func redisString(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", errRedisNil
+	}
+
+	return "", fmt.Errorf("redis: unexpected reply %T", reply)
+}
+
+// redisStrings converts array reply of strings, nil elements are empty
+func redisStrings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %T", reply)
+	}
+
+	res := make([]string, len(arr))
+	for i, v := range arr {
+		if v == nil {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("redis: unexpected reply %T", v)
+		}
+		res[i] = s
+	}
+
+	return res, nil
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Renderer returns html of page after its scripts are run,
+// links are extracted from it. body is the page as it was fetched.
+type Renderer interface {
+	Render(ctx context.Context, u *url.URL, body io.Reader) (io.Reader, error)
+}
+
+// WithRenderer makes Downloader extract links from pages rendered by r
+// instead of their raw html
+func WithRenderer(r Renderer) Option {
+	return func(d *Downloader) {
+		d.renderer = r
+	}
+}
+
+// RawRenderer returns pages as they were fetched, it's used by default
+type RawRenderer struct{}
+
+// Render returns body
+func (RawRenderer) Render(ctx context.Context, u *url.URL, body io.Reader) (io.Reader, error) {
+	return body, nil
+}
+
+// ExecRenderer runs headless browser process for every page
+// and reads rendered html from its stdout
+type ExecRenderer struct {
+	args     []string
+	withFile bool
+	timeout  time.Duration
+}
+
+// NewExecRenderer creates renderer running command split by spaces,
+// e.g. "chromium --headless --disable-gpu --dump-dom file://{file}".
+// {file} is replaced with temporary file with page html and <base>
+// of the page url. {url} is replaced with url of the page, browser
+// fetches it again then, without auth, cookies and headers of crawler.
+// If there are no placeholders url is added as the last argument.
+// Page html is passed on stdin if there is no {file}.
+func NewExecRenderer(command string, timeout time.Duration) (*ExecRenderer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("render command is empty")
+	}
+
+	hasURL, hasFile := false, false
+	for _, arg := range args {
+		hasURL = hasURL || strings.Contains(arg, "{url}")
+		hasFile = hasFile || strings.Contains(arg, "{file}")
+	}
+	if !hasURL && !hasFile {
+		args = append(args, "{url}")
+	}
+
+	return &ExecRenderer{args: args, withFile: hasFile, timeout: timeout}, nil
+}
+
+// Render runs the command and returns its output
+func (r *ExecRenderer) Render(ctx context.Context, u *url.URL, body io.Reader) (io.Reader, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var filename string
+	if r.withFile {
+		var err error
+		filename, err = writePageFile(u, body)
+		if err != nil {
+			return nil, fmt.Errorf("render failed: %v", err)
+		}
+		defer cleanTmp(filename)
+	}
+
+	args := make([]string, len(r.args))
+	for i, arg := range r.args {
+		arg = strings.Replace(arg, "{url}", u.String(), -1)
+		args[i] = strings.Replace(arg, "{file}", filename, -1)
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if !r.withFile {
+		cmd.Stdin = body
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// children of killed browser could keep stdout open
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("render failed: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("render failed: %v", err)
+	}
+
+	return stdout, nil
+}
+
+// writePageFile writes page html to temporary file, <base> makes
+// browser resolve relative links and scripts against the page url
+func writePageFile(u *url.URL, body io.Reader) (string, error) {
+	f, err := ioutil.TempFile("", "tegw-render-*.html")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(f, "<base href=\"%s\">", html.EscapeString(u.String()))
+	if err == nil {
+		_, err = io.Copy(f, body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanTmp(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fakeRenderer returns html from pages by url instead of running
+// a browser, pages which are not there are returned as fetched
+type fakeRenderer struct {
+	pages map[string]string
+
+	lock     sync.Mutex
+	rendered []string
+}
+
+func (r *fakeRenderer) Render(ctx context.Context, u *url.URL, body io.Reader) (io.Reader, error) {
+	r.lock.Lock()
+	r.rendered = append(r.rendered, u.String())
+	r.lock.Unlock()
+
+	html, ok := r.pages[u.String()]
+	if !ok {
+		return body, nil
+	}
+
+	return strings.NewReader(html), nil
+}
+
+func TestRenderedLinksAreQueued(t *testing.T) {
+	var lock sync.Mutex
+	requested := make(map[string]bool)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requested[req.URL.Path] = true
+		lock.Unlock()
+
+		switch req.URL.Path {
+		case "/":
+			// links are added by scripts
+			fmt.Fprint(w, `<html><script src="/app.js"></script><a href="/raw">raw</a></html>`)
+		case "/data.txt":
+			fmt.Fprint(w, "data")
+		default:
+			fmt.Fprint(w, `<html></html>`)
+		}
+	}))
+	defer srv.Close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-render-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	renderer := &fakeRenderer{pages: map[string]string{
+		srv.URL + "/": `<html><a href="/rendered">rendered</a><a href="/data.txt">data</a></html>`,
+	}}
+	sink := NewMemorySink()
+	d := NewDownloader("", stateDir, 2, 10, WithRenderer(renderer), WithSink(sink))
+
+	err = d.Run(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !requested["/rendered"] {
+		t.Error("link of rendered page is not crawled")
+	}
+	if requested["/raw"] {
+		t.Error("link of raw html is crawled")
+	}
+	if data, ok := sink.Get(hashURL(srv.URL+"/data.txt") + "_data.txt"); !ok || string(data) != "data" {
+		t.Errorf("file linked from rendered page: %q, %v, stored %v", data, ok, sink.Names())
+	}
+
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+	if len(renderer.rendered) != 2 {
+		t.Errorf("rendered pages: %v", renderer.rendered)
+	}
+}
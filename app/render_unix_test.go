@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func renderWith(t *testing.T, command, page string) string {
+	t.Helper()
+
+	r, err := NewExecRenderer(command, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse("http://example.com/a?b=1&c=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.Render(context.Background(), u, strings.NewReader(page))
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	data, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestExecRendererStdin(t *testing.T) {
+	// url is added as the last argument, it's $0 of the script
+	out := renderWith(t, "sh -c cat", "<html>page</html>")
+	if out != "<html>page</html>" {
+		t.Fatalf("rendered: %q", out)
+	}
+
+	out = renderWith(t, "echo {url}", "<html>page</html>")
+	if out != "http://example.com/a?b=1&c=2\n" {
+		t.Fatalf("rendered: %q", out)
+	}
+}
+
+func TestExecRendererFile(t *testing.T) {
+	out := renderWith(t, "cat {file}", "<html>page</html>")
+	want := `<base href="http://example.com/a?b=1&amp;c=2"><html>page</html>`
+	if out != want {
+		t.Fatalf("rendered: %q, expected %q", out, want)
+	}
+}
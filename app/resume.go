@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// partialFile describes interrupted download
+// which can be continued with Range request
+type partialFile struct {
+	Name         string // name in sink
+	ETag         string `yaml:"etag,omitempty"`
+	LastModified string `yaml:"last_modified,omitempty"`
+	Hash         string `yaml:"hash,omitempty"`   // state of sha256 of written data
+	Hashed       int64  `yaml:"hashed,omitempty"` // bytes in Hash
+}
+
+// resumeOffset returns partial download of input
+// and number of bytes already stored
+func (d *Downloader) resumeOffset(input string) (partialFile, int64) {
+	var p partialFile
+	d.filesLock.RLock()
+	r, ok := d.files[input]
+	if ok && r.Partial != nil {
+		p = *r.Partial
+	}
+	d.filesLock.RUnlock()
+
+	if p.Name == "" {
+		return p, 0
+	}
+
+	u, err := url.Parse(input)
+	if err != nil || d.decompressing(u) || d.charset == CharsetUTF8 {
+		// offset in decompressed or transcoded data can't be used in Range
+		return p, 0
+	}
+	if d.filter.checksContent() {
+		// filters need the whole content
+		return p, 0
+	}
+
+	rs, ok := d.sink.(ResumableSink)
+	if !ok {
+		return p, 0
+	}
+
+	return p, rs.PartialSize(p.Name)
+}
+
+// setRangeHeaders asks server to send the rest of the file
+// only if it was not changed since previous download
+func setRangeHeaders(req *http.Request, p partialFile, offset int64) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	if p.ETag != "" {
+		req.Header.Set("If-Range", p.ETag)
+		return
+	}
+	req.Header.Set("If-Range", p.LastModified)
+}
+
+// canResume returns true if response could be continued later
+func canResume(resp *http.Response) bool {
+	if resp.Header.Get("Accept-Ranges") == "none" {
+		return false
+	}
+
+	return validator(resp) != ""
+}
+
+// validator returns value which can be used in If-Range header.
+// Weak ETags are not allowed there.
+func validator(resp *http.Response) string {
+	etag := resp.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
+// validRange checks that partial response continues from offset
+func validRange(resp *http.Response, offset int64) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Range"),
+		fmt.Sprintf("bytes %d-", offset))
+}
+
+// suspendFile keeps partially downloaded file to continue it on next run.
+// checksum of size bytes written is kept as well, it's nil if not known.
+func (d *Downloader) suspendFile(input, name string, f SinkFile, resp *http.Response, checksum hash.Hash, size int64) {
+	sf, ok := f.(SuspendableFile)
+	if !ok || !canResume(resp) {
+		abortC(f)
+		return
+	}
+
+	err := sf.Suspend()
+	if err != nil {
+		log.Printf("ERR: failed to suspend file %s: %v", name, err)
+		abortC(f)
+		return
+	}
+
+	p := partialFile{Name: name}
+	etag := resp.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		p.ETag = etag
+	} else {
+		p.LastModified = resp.Header.Get("Last-Modified")
+	}
+	if checksum != nil {
+		p.saveHash(checksum, size)
+	}
+
+	d.filesLock.Lock()
+	d.fileRecord(input).Partial = &p
+	d.filesLock.Unlock()
+
+	log.Printf("suspended %s", input)
+}
+
+// forgetPartial removes suspended file of input and its record
+func (d *Downloader) forgetPartial(input, name string) {
+	d.dropPartial(name)
+
+	d.filesLock.Lock()
+	if r, ok := d.files[input]; ok {
+		r.Partial = nil
+	}
+	d.filesLock.Unlock()
+}
+
+// dropPartial removes suspended file which can not be resumed
+func (d *Downloader) dropPartial(name string) {
+	f, err := d.sink.(ResumableSink).Resume(name)
+	if err != nil {
+		return
+	}
+	abortC(f)
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns next time a job should run
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// ParseSchedule parses interval in form "@every 1h30m" (job
+// is run at start, then the interval after every run),
+// one of "@hourly", "@daily", "@weekly", "@monthly"
+// or cron expression "minute hour day-of-month month day-of-week"
+func ParseSchedule(s string) (Schedule, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %v", err)
+		}
+		if d < time.Minute {
+			return nil, errors.New("interval should be at least 1m")
+		}
+		return intervalSchedule(d), nil
+	}
+
+	switch s {
+	case "@hourly":
+		s = "0 * * * *"
+	case "@daily":
+		s = "0 0 * * *"
+	case "@weekly":
+		s = "0 0 * * 0"
+	case "@monthly":
+		s = "0 0 1 * *"
+	}
+
+	return parseCron(s)
+}
+
+// intervalSchedule is run by Daemon at start,
+// then the interval after every run
+type intervalSchedule time.Duration
+
+func (i intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// cronSchedule has a set of allowed values for every field
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(s string) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression should have 5 fields: minute hour day month weekday")
+	}
+
+	c := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+
+	var err error
+	parts := []struct {
+		dst      *map[int]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, p := range parts {
+		*p.dst, err = parseCronField(fields[i], p.min, p.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron field %q: %v", fields[i], err)
+		}
+	}
+
+	// both 0 and 7 are sunday
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+
+	return c, nil
+}
+
+// parseCronField parses comma separated list of
+// '*', 'n', 'a-b' with optional '/step'
+func parseCronField(s string, min, max int) (map[int]bool, error) {
+	res := make(map[int]bool)
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			v, err := strconv.Atoi(part[slash+1:])
+			if err != nil || v <= 0 {
+				return nil, errors.New("invalid step")
+			}
+			step = v
+			part = part[:slash]
+		}
+
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(bounds[0])
+			b, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("invalid range")
+			}
+			from, to = a, b
+		default:
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, errors.New("invalid value")
+			}
+			from, to = v, v
+			if step > 1 {
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("value out of range %d-%d", min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			res[v] = true
+		}
+	}
+
+	return res, nil
+}
+
+// dayMatches uses cron rule: if both day of month and day of week
+// are restricted, day matches any of them
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	// giving up after 5 years, e.g. for "0 0 30 2 *"
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
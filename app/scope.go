@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// WithSeeds makes Downloader start crawling from seeds
+// in addition to the url passed to Run
+func WithSeeds(seeds []*url.URL) Option {
+	return func(d *Downloader) {
+		d.seeds = seeds
+	}
+}
+
+// WithScope limits crawled pages to urls under any of scope urls:
+// with the same host and path starting with their path.
+// By default pages under the url passed to Run and seeds are crawled.
+func WithScope(scope []*url.URL) Option {
+	return func(d *Downloader) {
+		d.scope = scope
+	}
+}
+
+// addSeeds queues the input url and seeds
+func (d *Downloader) addSeeds(u *url.URL) {
+	d.addURL(u, 0)
+	for _, seed := range d.seeds {
+		d.addURL(seed, 0)
+	}
+}
+
+// checkURL checks if input URL is under one of scope urls
+func (d *Downloader) checkURL(u *url.URL) error {
+	scope := d.scope
+	if len(scope) == 0 {
+		scope = append([]*url.URL{d.baseURL}, d.seeds...)
+	}
+
+	var err error
+	for _, s := range scope {
+		err = inScope(s, u)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// inScope checks if input URL has the same domain
+// as base and it's path contains path of base.
+// It does not check if the scheme is different.
+func inScope(base, u *url.URL) error {
+	if base.Host != u.Host {
+		return errors.New("invalid host")
+	}
+
+	basePath := base.Path
+	newPath := u.Path
+
+	if basePath == newPath {
+		return nil
+	}
+
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+
+	if !strings.HasPrefix(newPath, basePath) {
+		return errors.New("invalid path")
+	}
+
+	return nil
+}
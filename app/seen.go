@@ -0,0 +1,414 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// SeenMode defines where Downloader remembers already queued urls
+type SeenMode string
+
+const (
+	// SeenMemory keeps all urls with their state in memory
+	SeenMemory SeenMode = "memory"
+	// SeenDisk keeps urls in bloom filter confirmed by files
+	// in stateDir/seen, only pending urls are kept in memory
+	SeenDisk SeenMode = "disk"
+)
+
+// ParseSeenMode parses mode name
+func ParseSeenMode(s string) (SeenMode, error) {
+	switch m := SeenMode(s); m {
+	case SeenMemory, SeenDisk:
+		return m, nil
+	}
+
+	return "", errors.New("seen mode should be one of: memory, disk")
+}
+
+// WithSeenSet sets where already queued urls are remembered.
+// expected is estimated number of urls for SeenDisk,
+// it defines size of bloom filter.
+func WithSeenSet(mode SeenMode, expected int) Option {
+	return func(d *Downloader) {
+		d.seenMode = mode
+		d.seenExpected = expected
+	}
+}
+
+// seenSet remembers keys on disk
+type seenSet interface {
+	// add returns true if key was not in the set before
+	add(key string) bool
+
+	// reset removes all keys
+	reset() error
+}
+
+// seenURL reports if page was queued before and remembers it otherwise.
+// It should be called with urlsLock held.
+func (d *Downloader) seenURL(link string) bool {
+	if _, ok := d.urls[link]; ok {
+		return true
+	}
+
+	return d.seen != nil && !d.seen.add("u "+link)
+}
+
+// seenFile is the same as seenURL for files.
+// It should be called with filesLock held.
+func (d *Downloader) seenFile(link string) bool {
+	if _, ok := d.files[link]; ok {
+		return true
+	}
+
+	return d.seen != nil && !d.seen.add("f "+link)
+}
+
+// doneURL marks page as processed with status.
+// With disk seen set processed pages are forgotten as they
+// are remembered on disk, their records are written to the journal.
+// It should be called with urlsLock held.
+func (d *Downloader) doneURL(link, status string) {
+	atomic.AddInt64(&d.pagesDone, 1)
+
+	r := d.urlRecord(link)
+	r.Status = status
+
+	if d.seen != nil {
+		d.journal.write(KindPage, link, r)
+		delete(d.urls, link)
+	}
+}
+
+// doneFile is the same as doneURL for files.
+// It should be called with filesLock held.
+func (d *Downloader) doneFile(link, status string) {
+	atomic.AddInt64(&d.filesDone, 1)
+
+	r := d.fileRecord(link)
+	r.Status = status
+	r.Partial = nil
+
+	if d.seen != nil {
+		d.journal.write(KindFile, link, r)
+		delete(d.files, link)
+	}
+}
+
+// resetSeen forgets all seen urls and records of processed ones
+func (d *Downloader) resetSeen() error {
+	err := d.seen.reset()
+	if err != nil {
+		return err
+	}
+
+	return d.journal.reset()
+}
+
+// rebuildSeen makes disk seen set match the state after a run which
+// was not stopped cleanly. Urls seen after the state was saved are
+// forgotten, so they are found again on pages they were queued from.
+func (d *Downloader) rebuildSeen(s *state) error {
+	log.Printf("WARN: previous run was not stopped cleanly, rebuilding seen urls")
+
+	if s.JournalSize != nil {
+		err := d.journal.(*journal).truncate(*s.JournalSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := d.seen.reset()
+	if err != nil {
+		return err
+	}
+
+	for link := range s.URLs {
+		d.seen.add("u " + link)
+	}
+	for link := range s.Files {
+		d.seen.add("f " + link)
+	}
+	for _, item := range s.Frontier {
+		if item.File {
+			d.seen.add("f " + item.URL)
+		} else {
+			d.seen.add("u " + item.URL)
+		}
+	}
+
+	return readJournal(path.Join(d.stateDir, journalFile), func(e journalEntry) {
+		if e.Kind == KindFile {
+			d.seen.add("f " + e.URL)
+		} else {
+			d.seen.add("u " + e.URL)
+		}
+	})
+}
+
+const (
+	seenBuckets     = 4096
+	seenRecentLimit = 100000
+	seenFalseRate   = 0.01
+)
+
+// diskSeenSet checks keys with bloom filter and
+// confirms positive answers with bucket files on disk
+type diskSeenSet struct {
+	lock     sync.Mutex
+	dir      string
+	expected int
+	bloom    *bloomFilter
+	recent   map[string]struct{} // recently confirmed keys
+	clean    bool                // matches the state, it was saved after the last run
+}
+
+// seenCleanFile marks seen set which matches the saved state.
+// It's removed while urls are added.
+const seenCleanFile = "clean"
+
+// invalidateSeen makes disk seen set in stateDir rebuilt
+// from the state on the next run
+func invalidateSeen(stateDir string) error {
+	err := os.Remove(path.Join(stateDir, "seen", seenCleanFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// openDiskSeenSet opens set stored in dir
+// and loads existing keys into bloom filter
+func openDiskSeenSet(dir string, expected int) (*diskSeenSet, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &diskSeenSet{
+		dir:      dir,
+		expected: expected,
+		bloom:    newBloomFilter(expected, seenFalseRate),
+		recent:   make(map[string]struct{}, 1000),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	for _, info := range files {
+		if info.Name() == seenCleanFile {
+			s.clean = true
+			continue
+		}
+		err = s.forEach(path.Join(dir, info.Name()), func(key string) bool {
+			s.bloom.add(key)
+			n++
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("loaded %d seen urls", n)
+
+	return s, nil
+}
+
+// setClean marks if seen set matches the saved state
+func (s *diskSeenSet) setClean(clean bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	filename := path.Join(s.dir, seenCleanFile)
+	var err error
+	if clean {
+		err = ioutil.WriteFile(filename, nil, 0644)
+	} else {
+		err = os.Remove(filename)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("ERR: failed to mark seen urls: %v", err)
+	}
+}
+
+func (s *diskSeenSet) add(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.recent[key]; ok {
+		return false
+	}
+
+	bucket := s.bucket(key)
+
+	if s.bloom.has(key) && s.onDisk(bucket, key) {
+		s.remember(key)
+		return false
+	}
+
+	err := appendLine(bucket, key)
+	if err != nil {
+		// better to download twice than to lose url
+		log.Printf("ERR: failed to store seen url: %v", err)
+	}
+	s.bloom.add(key)
+	s.remember(key)
+
+	return true
+}
+
+func (s *diskSeenSet) reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		err = os.Remove(path.Join(s.dir, info.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.bloom = newBloomFilter(s.expected, seenFalseRate)
+	s.recent = make(map[string]struct{}, 1000)
+
+	return nil
+}
+
+func (s *diskSeenSet) remember(key string) {
+	if len(s.recent) >= seenRecentLimit {
+		s.recent = make(map[string]struct{}, 1000)
+	}
+	s.recent[key] = struct{}{}
+}
+
+func (s *diskSeenSet) bucket(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return path.Join(s.dir, fmt.Sprintf("%03x", h.Sum32()%seenBuckets))
+}
+
+func (s *diskSeenSet) onDisk(bucket, key string) bool {
+	found := false
+	err := s.forEach(bucket, func(k string) bool {
+		found = k == key
+		return !found
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERR: failed to read seen urls: %v", err)
+	}
+
+	return found
+}
+
+// forEach calls f for every key in bucket until f returns false
+func (s *diskSeenSet) forEach(bucket string, f func(string) bool) error {
+	file, err := os.Open(bucket)
+	if err != nil {
+		return err
+	}
+	defer closeC(file)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !f(scanner.Text()) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+func appendLine(name, line string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		closeC(f)
+		return err
+	}
+
+	return f.Close()
+}
+
+// bloomFilter is a probabilistic set without false negatives
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64 // number of bits
+	hashes uint64
+}
+
+// newBloomFilter creates filter for n items with false positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1000 {
+		n = 1000
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		hashes: k,
+	}
+}
+
+// positions uses double hashing to get k bit positions
+func (b *bloomFilter) positions(key string, f func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1 := sum & 0xffffffff
+	h2 := sum>>32 | 1
+
+	for i := uint64(0); i < b.hashes; i++ {
+		f((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloomFilter) add(key string) {
+	b.positions(key, func(pos uint64) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+func (b *bloomFilter) has(key string) bool {
+	res := true
+	b.positions(key, func(pos uint64) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			res = false
+		}
+	})
+
+	return res
+}
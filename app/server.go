@@ -0,0 +1,624 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// job statuses
+const (
+	JobQueued      = "queued"
+	JobRunning     = "running"
+	JobComplete    = "complete"
+	JobInterrupted = "interrupted" // stopped with server, continued on its next start
+	JobCancelled   = "cancelled"
+	JobFailed      = "failed"
+)
+
+// jobFile is name of the file with job info in job's state dir
+const jobFile = "job.json"
+
+// JobSpec describes crawl job submitted to Server
+type JobSpec struct {
+	Name   string    `json:"name,omitempty"`
+	Seeds  []string  `json:"seeds"`
+	Scope  []string  `json:"scope,omitempty"` // seeds if empty
+	Limits JobLimits `json:"limits"`
+}
+
+// JobLimits overrides limits of the server for a job, 0 means server's limit
+type JobLimits struct {
+	MaxDepth    int   `json:"max_depth,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	MaxPageSize int64 `json:"max_page_size,omitempty"`
+}
+
+// JobInfo describes state and progress of a job
+type JobInfo struct {
+	ID       string     `json:"id"`
+	Spec     JobSpec    `json:"spec"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Progress Stats      `json:"progress"`
+}
+
+type serverJob struct {
+	info       JobInfo
+	downloader *Downloader // nil until job is started
+	cancelled  bool
+}
+
+// JobOptions returns Downloader options of job with id,
+// options of job spec are added to them
+type JobOptions func(id string) []Option
+
+// Server runs crawl jobs submitted with its API.
+// Every job has its own Downloader, state in stateDir/<id>
+// and output in outDir/<id>.
+type Server struct {
+	stateDir string
+	outDir   string
+	threads  int
+	timeout  int
+	options  JobOptions
+
+	jobs     map[string]*serverJob
+	lock     sync.Mutex
+	slots    chan struct{} // limits number of running jobs
+	wg       sync.WaitGroup
+	stopped  bool
+	lastID   int64
+	stopping chan struct{}
+}
+
+// NewServer creates server running up to maxJobs jobs at once.
+// Jobs of the previous server in stateDir are loaded,
+// interrupted ones are continued by Run.
+func NewServer(stateDir, outDir string, threads, timeout, maxJobs int, options JobOptions) (*Server, error) {
+	s := &Server{
+		stateDir: stateDir,
+		outDir:   outDir,
+		threads:  threads,
+		timeout:  timeout,
+		options:  options,
+		jobs:     make(map[string]*serverJob),
+		slots:    make(chan struct{}, maxJobs),
+		stopping: make(chan struct{}),
+	}
+
+	err := os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		info, err := readJob(path.Join(stateDir, dir.Name(), jobFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("ERR: failed to load job %s: %v", dir.Name(), err)
+			continue
+		}
+		s.jobs[info.ID] = &serverJob{info: *info}
+	}
+
+	return s, nil
+}
+
+// Run starts jobs left from the previous server and waits
+// until Shutdown is called and running jobs are stopped
+func (s *Server) Run() {
+	s.lock.Lock()
+	jobs := make([]*serverJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		switch job.info.Status {
+		case JobQueued, JobRunning, JobInterrupted:
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].info.Created.Before(jobs[j].info.Created)
+	})
+	for _, job := range jobs {
+		log.Printf("job %s: continuing", job.info.ID)
+		s.startJob(job)
+	}
+	s.lock.Unlock()
+
+	<-s.stopping
+	s.wg.Wait()
+}
+
+// Submit validates spec and queues the job
+func (s *Server) Submit(spec JobSpec) (JobInfo, error) {
+	err := spec.validate()
+	if err != nil {
+		return JobInfo{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return JobInfo{}, errors.New("server is stopping")
+	}
+
+	job := &serverJob{info: JobInfo{
+		ID:      s.newID(),
+		Spec:    spec,
+		Status:  JobQueued,
+		Created: time.Now(),
+	}}
+	err = s.saveJob(job)
+	if err != nil {
+		return JobInfo{}, err
+	}
+
+	s.jobs[job.info.ID] = job
+	log.Printf("job %s: submitted, seeds: %s", job.info.ID, strings.Join(spec.Seeds, ", "))
+	s.startJob(job)
+
+	return job.info, nil
+}
+
+// newID returns unique id of the job based on current time
+func (s *Server) newID() string {
+	id := time.Now().UnixNano() / int64(time.Millisecond)
+	if id <= s.lastID {
+		id = s.lastID + 1
+	}
+	s.lastID = id
+
+	return strconv.FormatInt(id, 36)
+}
+
+// startJob runs job when there is a free slot,
+// it should be called with s.lock held
+func (s *Server) startJob(job *serverJob) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		select {
+		case s.slots <- struct{}{}:
+		case <-s.stopping:
+			return
+		}
+		defer func() {
+			<-s.slots
+		}()
+
+		s.runJob(job)
+	}()
+}
+
+func (s *Server) runJob(job *serverJob) {
+	s.lock.Lock()
+	if job.cancelled || s.stopped {
+		s.lock.Unlock()
+		return
+	}
+
+	id := job.info.ID
+	seeds, opts := job.info.Spec.parse()
+	opts = append(s.options(id), opts...)
+	d := NewDownloader(path.Join(s.outDir, id), path.Join(s.stateDir, id), s.threads, s.timeout, opts...)
+
+	now := time.Now()
+	job.downloader = d
+	job.info.Status = JobRunning
+	job.info.Started = &now
+	s.saveJobLogged(job)
+	s.lock.Unlock()
+
+	log.Printf("job %s: starting", id)
+	err := d.Run(seeds)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now = time.Now()
+	job.info.Progress = d.Stats()
+	job.info.Finished = &now
+	job.info.Error = ""
+	job.downloader = nil
+
+	switch {
+	case err == nil:
+		job.info.Status = JobComplete
+	case err == ErrInterrupted && job.cancelled:
+		job.info.Status = JobCancelled
+	case err == ErrInterrupted:
+		job.info.Status = JobInterrupted
+	default:
+		job.info.Status = JobFailed
+		job.info.Error = err.Error()
+	}
+	s.saveJobLogged(job)
+
+	log.Printf("job %s: %s", id, job.info.Status)
+}
+
+// Jobs returns all jobs ordered by creation time
+func (s *Server) Jobs() []JobInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make([]JobInfo, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		res = append(res, job.current())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+
+	return res
+}
+
+// Job returns job with id
+func (s *Server) Job(id string) (JobInfo, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return JobInfo{}, false
+	}
+
+	return job.current(), true
+}
+
+// current returns info with progress of running job
+func (job *serverJob) current() JobInfo {
+	info := job.info
+	if job.downloader != nil {
+		info.Progress = job.downloader.Stats()
+	}
+
+	return info
+}
+
+// errJobFinished is returned by Cancel for jobs which are not queued or running
+var errJobFinished = errors.New("job is already finished")
+
+// Cancel stops job immediately, downloads in flight are thrown away.
+// State of the job is saved and it's not continued.
+func (s *Server) Cancel(id string) (JobInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return JobInfo{}, os.ErrNotExist
+	}
+
+	switch job.info.Status {
+	case JobQueued, JobRunning:
+	case JobInterrupted:
+		// waits to be continued
+	default:
+		return JobInfo{}, errJobFinished
+	}
+
+	job.cancelled = true
+	if job.downloader != nil {
+		job.downloader.Stop()
+	} else {
+		now := time.Now()
+		job.info.Status = JobCancelled
+		job.info.Finished = &now
+		s.saveJobLogged(job)
+	}
+	log.Printf("job %s: cancelling", id)
+
+	return job.current(), nil
+}
+
+// Shutdown stops running jobs, see Downloader.Shutdown.
+// They are continued on the next start of the server.
+func (s *Server) Shutdown(drain time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stopping)
+
+	for _, job := range s.jobs {
+		if job.downloader != nil {
+			job.downloader.Shutdown(drain)
+		}
+	}
+}
+
+// Manifest writes state entries of job in format csv or json, see ExportState.
+// Entries of running job are taken from its Downloader,
+// so they include its progress since the job was started.
+func (s *Server) Manifest(id, format string, w io.Writer) error {
+	s.lock.Lock()
+	job, ok := s.jobs[id]
+	var d *Downloader
+	if ok {
+		d = job.downloader
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		return os.ErrNotExist
+	}
+	if d == nil {
+		return ExportState(path.Join(s.stateDir, id), format, w)
+	}
+
+	entries, err := d.Entries()
+	if err != nil {
+		return err
+	}
+
+	return writeEntries(entries, format, w)
+}
+
+// parse converts seeds, scope and limits to Downloader options.
+// The first seed is returned separately for Run.
+func (spec JobSpec) parse() (string, []Option) {
+	if len(spec.Seeds) == 0 {
+		return "", nil
+	}
+
+	opts := make([]Option, 0, 5)
+	seeds, _ := parseURLs(spec.Seeds[1:])
+	if len(seeds) > 0 {
+		opts = append(opts, WithSeeds(seeds))
+	}
+	scope, _ := parseURLs(spec.Scope)
+	if len(scope) > 0 {
+		opts = append(opts, WithScope(scope))
+	}
+
+	l := spec.Limits
+	if l.MaxDepth > 0 {
+		opts = append(opts, WithMaxDepth(l.MaxDepth))
+	}
+	if l.MaxFileSize > 0 {
+		opts = append(opts, WithMaxFileSize(l.MaxFileSize))
+	}
+	if l.MaxPageSize > 0 {
+		opts = append(opts, WithMaxPageSize(l.MaxPageSize))
+	}
+
+	return spec.Seeds[0], opts
+}
+
+// validate checks spec submitted to the server
+func (spec JobSpec) validate() error {
+	if len(spec.Seeds) == 0 {
+		return errors.New("at least one seed should be set")
+	}
+
+	_, err := parseURLs(spec.Seeds)
+	if err != nil {
+		return fmt.Errorf("invalid seed: %v", err)
+	}
+	_, err = parseURLs(spec.Scope)
+	if err != nil {
+		return fmt.Errorf("invalid scope: %v", err)
+	}
+
+	l := spec.Limits
+	if l.MaxDepth < 0 || l.MaxFileSize < 0 || l.MaxPageSize < 0 {
+		return errors.New("limits should not be negative")
+	}
+
+	return nil
+}
+
+// parseURLs parses absolute http or https urls
+func parseURLs(links []string) ([]*url.URL, error) {
+	res := make([]*url.URL, 0, len(links))
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not absolute http url", link)
+		}
+		res = append(res, u)
+	}
+
+	return res, nil
+}
+
+func (s *Server) saveJob(job *serverJob) error {
+	dir := path.Join(s.stateDir, job.info.ID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(job.info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(dir, jobFile), data)
+}
+
+func (s *Server) saveJobLogged(job *serverJob) {
+	err := s.saveJob(job)
+	if err != nil {
+		log.Printf("ERR: failed to save job %s: %v", job.info.ID, err)
+	}
+}
+
+func readJob(filename string) (*JobInfo, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &JobInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Handler returns http handler of the server API:
+//
+//	GET  /jobs                    - all jobs
+//	POST /jobs                    - submit JobSpec, returns JobInfo
+//	GET  /jobs/<id>               - JobInfo with progress
+//	POST /jobs/<id>/cancel
+//	GET  /jobs/<id>/manifest      - state entries of the job, ?format=csv or json
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, s.Jobs())
+		case "POST":
+			s.handleSubmit(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		id, action := parts[0], ""
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+		if id == "" || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == "GET":
+			info, ok := s.Job(id)
+			if !ok {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, info)
+		case action == "cancel" && r.Method == "POST":
+			info, err := s.Cancel(id)
+			if err != nil {
+				writeJobError(w, err)
+				return
+			}
+			writeJSON(w, info)
+		case action == "manifest" && r.Method == "GET":
+			s.handleManifest(w, r, id)
+		case action == "" || action == "cancel" || action == "manifest":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	return mux
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	spec := JobSpec{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&spec)
+	if err != nil {
+		http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = spec.validate()
+	if err != nil {
+		http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := s.Submit(spec)
+	if err != nil {
+		log.Printf("ERR: failed to submit job: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, info)
+}
+
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request, id string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format should be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	// manifest is written only if it's read successfully
+	buf := &bytes.Buffer{}
+	err := s.Manifest(id, format, buf)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("ERR: failed to write response: %v", err)
+	}
+}
+
+// writeJobError writes error of job request
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "job not found", http.StatusNotFound)
+	case err == ErrNoState:
+		http.Error(w, "manifest is not saved yet", http.StatusNotFound)
+	case err == errJobFinished:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("ERR: job request failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManifestOfRunningJob(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><a href="/slow.txt">slow</a></html>`)
+		case "/slow.txt":
+			<-release
+			fmt.Fprint(w, "data")
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "tegw-server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewServer(dir, dir, 2, 10, 1, func(id string) []Option {
+		return []Option{WithSink(NewMemorySink())}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(0)
+
+	job, err := s.Submit(JobSpec{Seeds: []string{srv.URL + "/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := func() map[string]string {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		err := s.Manifest(job.ID, "json", buf)
+		if err == ErrNoState {
+			// job is not started yet
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("manifest: %v", err)
+		}
+		entries := []StateEntry{}
+		err = json.Unmarshal(buf.Bytes(), &entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]string, len(entries))
+		for _, e := range entries {
+			res[e.URL] = e.Status
+		}
+		return res
+	}
+
+	// the page is done while the file is being downloaded
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := manifest()
+		if m[srv.URL+"/"] == StatusDone && m[srv.URL+"/slow.txt"] == StatusPending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("manifest of running job: %v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	for {
+		info, _ := s.Job(job.ID)
+		if info.Status == JobComplete {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is %s", info.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := manifest(); m[srv.URL+"/slow.txt"] != StatusDone {
+		t.Fatalf("manifest of finished job: %v", m)
+	}
+}
@@ -0,0 +1,472 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// sharedPoll is how often shared frontier is checked
+// when there is nothing to lease
+var sharedPoll = 500 * time.Millisecond
+
+// sharedWindow is number of queued items checked for a free lease at once
+const sharedWindow = 64
+
+// SharedStore keeps frontier, seen urls and records of a distributed
+// crawl in Redis, so workers on several machines can crawl the same site.
+// Keys are:
+//
+//	<prefix>base        url crawl started from, set by coordinator
+//	<prefix>pages       sorted set of queued pages in crawl order
+//	<prefix>files       sorted set of queued files
+//	<prefix>seq         counter for crawl order
+//	<prefix>seen        set of seen pages and files
+//	<prefix>records     hash of records of processed pages and files
+//	<prefix>lease:<id>  lease of item in flight, expires with dead worker
+type SharedStore struct {
+	client   *RedisClient
+	prefix   string
+	leaseTTL time.Duration
+	owner    string // lease owner, hostname:pid
+}
+
+// NewSharedStore creates store with keys under prefix.
+// Items leased by worker are given out again if lease
+// is not renewed in leaseTTL.
+func NewSharedStore(client *RedisClient, prefix string, leaseTTL time.Duration) *SharedStore {
+	hostname, _ := os.Hostname()
+
+	return &SharedStore{
+		client:   client,
+		prefix:   prefix,
+		leaseTTL: leaseTTL,
+		owner:    fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+}
+
+// WithSharedStore makes Downloader a worker of distributed crawl
+// which takes pages and files from s. It's started with Work.
+func WithSharedStore(s *SharedStore) Option {
+	return func(d *Downloader) {
+		d.shared = s
+		d.seen = sharedSeenSet{s}
+		d.journal = sharedRecords{s}
+	}
+}
+
+func (s *SharedStore) key(name string) string {
+	return s.prefix + name
+}
+
+// pending returns number of queued and leased items
+func (s *SharedStore) pending() (int64, error) {
+	replies, err := s.client.pipeline([][]string{
+		{"ZCARD", s.key("pages")},
+		{"ZCARD", s.key("files")},
+	})
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, reply := range replies {
+		v, err := redisInt(reply, nil)
+		if err != nil {
+			return 0, err
+		}
+		n += v
+	}
+
+	return n, nil
+}
+
+// Work processes pages and files of distributed crawl until there
+// is nothing left or crawl is stopped. It waits for coordinator
+// to start the crawl.
+func (d *Downloader) Work() error {
+	if d.shared == nil {
+		return errors.New("shared store is not set")
+	}
+
+	base, err := d.shared.waitBase(d.dispatchCtx)
+	if err != nil {
+		if d.dispatchCtx.Err() != nil {
+			return ErrInterrupted
+		}
+		return err
+	}
+
+	d.baseURL, err = url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid base url in shared store: %v", err)
+	}
+
+	atomic.StoreInt64(&d.pagesDone, 0)
+	atomic.StoreInt64(&d.filesDone, 0)
+	log.Printf("working on crawl of %s", base)
+
+	renewCtx, stopRenew := context.WithCancel(d.ctx)
+	go d.frontier.(*sharedFrontier).renewLeases(renewCtx)
+	d.runWorkers(d.dispatchCtx, d.ctx)
+	stopRenew()
+	if d.dispatchCtx.Err() != nil {
+		return ErrInterrupted
+	}
+
+	return nil
+}
+
+// waitBase waits until coordinator starts the crawl
+func (s *SharedStore) waitBase(ctx context.Context) (string, error) {
+	logged := false
+	for {
+		base, err := redisString(s.client.Do("GET", s.key("base")))
+		if err != errRedisNil {
+			return base, err
+		}
+
+		if !logged {
+			log.Print("waiting for coordinator to start crawl...")
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(sharedPoll):
+		}
+	}
+}
+
+// sharedSeenSet is seenSet in Redis
+type sharedSeenSet struct {
+	s *SharedStore
+}
+
+func (ss sharedSeenSet) add(key string) bool {
+	n, err := redisInt(ss.s.client.Do("SADD", ss.s.key("seen"), key))
+	if err != nil {
+		// crawling twice is better than not crawling at all
+		log.Printf("ERR: failed to add seen url: %v", err)
+		return true
+	}
+
+	return n == 1
+}
+
+func (ss sharedSeenSet) reset() error {
+	_, err := ss.s.client.Do("DEL", ss.s.key("seen"))
+	return err
+}
+
+// sharedRecords is recordLog in Redis, records are
+// collected to the state by coordinator
+type sharedRecords struct {
+	s *SharedStore
+}
+
+func (sr sharedRecords) write(kind, link string, r *record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("ERR: failed to marshal record of %s: %v", link, err)
+		return
+	}
+
+	_, err = sr.s.client.Do("HSET", sr.s.key("records"), kind+" "+link, string(data))
+	if err != nil {
+		log.Printf("ERR: failed to report record of %s: %v", link, err)
+	}
+}
+
+func (sr sharedRecords) reset() error {
+	_, err := sr.s.client.Do("DEL", sr.s.key("records"))
+	return err
+}
+
+// sharedFrontier is queue in Redis. Items stay in sorted sets
+// until they are processed, workers take them with leases
+// which expire if worker dies.
+type sharedFrontier struct {
+	s     *SharedStore
+	order CrawlOrder
+
+	lock   sync.Mutex
+	leases map[string]string // url -> member of sorted set
+}
+
+func (s *SharedStore) frontier(order CrawlOrder) *sharedFrontier {
+	return &sharedFrontier{
+		s:      s,
+		order:  order,
+		leases: make(map[string]string),
+	}
+}
+
+func (f *sharedFrontier) push(item frontierItem) {
+	err := f.s.push(item, f.order)
+	if err != nil {
+		log.Printf("ERR: failed to queue %s: %v", item.URL, err)
+	}
+}
+
+// push adds item to the frontier with score in crawl order
+func (s *SharedStore) push(item frontierItem, order CrawlOrder) error {
+	member, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	key := s.key("pages")
+	if item.File {
+		key = s.key("files")
+	}
+
+	var score float64
+	if order == OrderPriority && !item.File {
+		score = -item.Priority
+	} else {
+		seq, err := redisInt(s.client.Do("INCR", s.key("seq")))
+		if err != nil {
+			return err
+		}
+		score = float64(seq)
+		if order == OrderDFS && !item.File {
+			score = -score
+		}
+	}
+
+	_, err = s.client.Do("ZADD", key, "NX", strconv.FormatFloat(score, 'f', -1, 64), string(member))
+	return err
+}
+
+// next leases the first free item, files go first
+func (f *sharedFrontier) next() (item frontierItem, ok bool, done bool) {
+	for _, key := range []string{f.s.key("files"), f.s.key("pages")} {
+		member, err := f.lease(key)
+		if err != nil {
+			log.Printf("ERR: failed to lease from shared frontier: %v", err)
+			return item, false, false
+		}
+		if member == "" {
+			continue
+		}
+
+		err = json.Unmarshal([]byte(member), &item)
+		if err != nil {
+			log.Printf("ERR: invalid item in shared frontier: %v", err)
+			f.drop(key, member)
+			continue
+		}
+
+		f.lock.Lock()
+		f.leases[item.URL] = member
+		f.lock.Unlock()
+
+		return item, true, false
+	}
+
+	n, err := f.s.pending()
+	if err != nil {
+		log.Printf("ERR: failed to check shared frontier: %v", err)
+		return item, false, false
+	}
+
+	// leased items are in the frontier until they are processed
+	return item, false, n == 0
+}
+
+// lease takes the first item of sorted set which is not leased.
+// Empty member is returned if there are no free items.
+func (f *sharedFrontier) lease(key string) (string, error) {
+	for start := 0; ; start += sharedWindow {
+		members, err := redisStrings(f.s.client.Do("ZRANGE", key,
+			strconv.Itoa(start), strconv.Itoa(start+sharedWindow-1)))
+		if err != nil || len(members) == 0 {
+			return "", err
+		}
+
+		args := []string{"MGET"}
+		for _, member := range members {
+			args = append(args, f.s.leaseKey(member))
+		}
+		owners, err := redisStrings(f.s.client.Do(args...))
+		if err != nil {
+			return "", err
+		}
+
+		for i, member := range members {
+			if owners[i] != "" {
+				continue
+			}
+
+			// other worker could take it since MGET
+			// or even process it since ZRANGE
+			replies, err := f.s.client.pipeline([][]string{
+				{"SET", f.s.leaseKey(member), f.s.owner,
+					"NX", "PX", strconv.FormatInt(int64(f.s.leaseTTL/time.Millisecond), 10)},
+				{"ZSCORE", key, member},
+			})
+			if err == nil {
+				err = replyError(replies)
+			}
+			if err != nil {
+				if replies != nil && replies[0] == "OK" {
+					f.s.client.Do("DEL", f.s.leaseKey(member))
+				}
+				return "", err
+			}
+			if replies[0] == nil {
+				continue
+			}
+			if replies[1] == nil {
+				f.s.client.Do("DEL", f.s.leaseKey(member))
+				continue
+			}
+			return member, nil
+		}
+	}
+}
+
+func (s *SharedStore) leaseKey(member string) string {
+	return s.key("lease:" + hashURL(member))
+}
+
+// scripts changing leases only if they are still held by the worker,
+// expired lease could be taken by another worker
+const (
+	releaseLeaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+	renewLeasesScript = `local n = 0
+for _, key in ipairs(KEYS) do
+	if redis.call("GET", key) == ARGV[1] then
+		n = n + redis.call("PEXPIRE", key, ARGV[2])
+	end
+end
+return n`
+)
+
+// renewLeases extends leases of items in flight until ctx is done
+func (f *sharedFrontier) renewLeases(ctx context.Context) {
+	ttl := strconv.FormatInt(int64(f.s.leaseTTL/time.Millisecond), 10)
+
+	ticker := time.NewTicker(f.s.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.lock.Lock()
+		keys := make([]string, 0, len(f.leases))
+		for _, member := range f.leases {
+			keys = append(keys, f.s.leaseKey(member))
+		}
+		f.lock.Unlock()
+
+		if len(keys) == 0 {
+			continue
+		}
+		args := append([]string{"EVAL", renewLeasesScript, strconv.Itoa(len(keys))}, keys...)
+		n, err := redisInt(f.s.client.Do(append(args, f.s.owner, ttl)...))
+		if err != nil {
+			log.Printf("ERR: failed to renew leases: %v", err)
+			continue
+		}
+		if n < int64(len(keys)) {
+			log.Printf("WARN: %d leases expired, their items may be processed twice", int64(len(keys))-n)
+		}
+	}
+}
+
+// finish removes processed item from the frontier.
+// Lease of interrupted item is released for other workers.
+func (f *sharedFrontier) finish(item frontierItem, interrupted bool) {
+	f.lock.Lock()
+	member := f.leases[item.URL]
+	delete(f.leases, item.URL)
+	f.lock.Unlock()
+
+	key := f.s.key("pages")
+	if item.File {
+		key = f.s.key("files")
+	}
+
+	// item is removed before lease, so worker which
+	// takes the released lease sees it's processed
+	cmds := [][]string{{"EVAL", releaseLeaseScript, "1", f.s.leaseKey(member), f.s.owner}}
+	if !interrupted {
+		cmds = append([][]string{{"ZREM", key, member}}, cmds...)
+	}
+
+	replies, err := f.s.client.pipeline(cmds)
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		log.Printf("ERR: failed to finish %s in shared frontier: %v", item.URL, err)
+	}
+}
+
+// drop removes item which can't be processed
+func (f *sharedFrontier) drop(key, member string) {
+	replies, err := f.s.client.pipeline([][]string{
+		{"ZREM", key, member},
+		{"DEL", f.s.leaseKey(member)},
+	})
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		log.Printf("ERR: failed to drop invalid item: %v", err)
+	}
+}
+
+func (f *sharedFrontier) wait() <-chan struct{} {
+	ch := make(chan struct{})
+	time.AfterFunc(sharedPoll, func() {
+		close(ch)
+	})
+
+	return ch
+}
+
+func (f *sharedFrontier) empty() bool {
+	n, err := f.s.pending()
+	return err == nil && n == 0
+}
+
+func (f *sharedFrontier) stats() (int, int) {
+	f.lock.Lock()
+	inflight := len(f.leases)
+	f.lock.Unlock()
+
+	n, err := f.s.pending()
+	if err != nil {
+		return 0, inflight
+	}
+
+	return int(n), inflight
+}
+
+// items returns nothing as shared frontier is not saved in state
+func (f *sharedFrontier) items() []frontierItem {
+	return nil
+}
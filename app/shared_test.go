@@ -0,0 +1,613 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeRedis is in-process Redis with commands used by SharedStore.
+// Scripts are not interpreted, known ones are implemented here.
+type fakeRedis struct {
+	ln net.Listener
+
+	lock    sync.Mutex
+	strs    map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	failing map[string]bool // commands replying with error
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{
+		ln:      ln,
+		strs:    make(map[string]string),
+		expires: make(map[string]time.Time),
+		sets:    make(map[string]map[string]bool),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		failing: make(map[string]bool),
+	}
+	go r.serve()
+
+	return r
+}
+
+func (r *fakeRedis) url() string {
+	return "redis://" + r.ln.Addr().String()
+}
+
+func (r *fakeRedis) client(t *testing.T) *RedisClient {
+	c, err := NewRedisClient(r.url(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func (r *fakeRedis) close() {
+	closeC(r.ln)
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer closeC(conn)
+
+	br := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		req, err := readReply(br)
+		if err != nil {
+			return
+		}
+		arr, ok := req.([]interface{})
+		if !ok || len(arr) == 0 {
+			return
+		}
+		args := make([]string, len(arr))
+		for i, a := range arr {
+			args[i], _ = a.(string)
+		}
+
+		r.lock.Lock()
+		reply := r.exec(strings.ToUpper(args[0]), args[1:])
+		r.lock.Unlock()
+
+		writeReply(w, reply)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+// get returns string value of key which is not expired
+func (r *fakeRedis) get(key string) (string, bool) {
+	if at, ok := r.expires[key]; ok && !time.Now().Before(at) {
+		delete(r.strs, key)
+		delete(r.expires, key)
+	}
+
+	v, ok := r.strs[key]
+	return v, ok
+}
+
+func (r *fakeRedis) del(key string) int64 {
+	_, ok := r.get(key)
+	_, okSet := r.sets[key]
+	_, okHash := r.hashes[key]
+	_, okZset := r.zsets[key]
+	delete(r.strs, key)
+	delete(r.expires, key)
+	delete(r.sets, key)
+	delete(r.hashes, key)
+	delete(r.zsets, key)
+
+	if ok || okSet || okHash || okZset {
+		return 1
+	}
+	return 0
+}
+
+func (r *fakeRedis) pexpire(key, ms string) int64 {
+	if _, ok := r.get(key); !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(ms)
+	r.expires[key] = time.Now().Add(time.Duration(n) * time.Millisecond)
+
+	return 1
+}
+
+func (r *fakeRedis) exec(cmd string, args []string) interface{} {
+	if r.failing[cmd] {
+		return redisError("ERR " + cmd + " failed")
+	}
+
+	switch cmd {
+	case "GET":
+		if v, ok := r.get(args[0]); ok {
+			return v
+		}
+		return nil
+	case "MGET":
+		res := make([]interface{}, len(args))
+		for i, key := range args {
+			if v, ok := r.get(key); ok {
+				res[i] = v
+			}
+		}
+		return res
+	case "SET":
+		key := args[0]
+		_, exists := r.get(key)
+		var ttl string
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return nil
+				}
+			case "PX":
+				i++
+				ttl = args[i]
+			}
+		}
+		r.strs[key] = args[1]
+		delete(r.expires, key)
+		if ttl != "" {
+			r.pexpire(key, ttl)
+		}
+		return "OK"
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			n += r.del(key)
+		}
+		return n
+	case "PEXPIRE":
+		return r.pexpire(args[0], args[1])
+	case "INCR":
+		v, _ := r.get(args[0])
+		n, _ := strconv.ParseInt(v, 10, 64)
+		n++
+		r.strs[args[0]] = strconv.FormatInt(n, 10)
+		return n
+	case "SADD":
+		set := r.sets[args[0]]
+		if set == nil {
+			set = make(map[string]bool)
+			r.sets[args[0]] = set
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return n
+	case "HSET":
+		h := r.hashes[args[0]]
+		if h == nil {
+			h = make(map[string]string)
+			r.hashes[args[0]] = h
+		}
+		_, exists := h[args[1]]
+		h[args[1]] = args[2]
+		if exists {
+			return int64(0)
+		}
+		return int64(1)
+	case "HLEN":
+		return int64(len(r.hashes[args[0]]))
+	case "ZADD":
+		z := r.zsets[args[0]]
+		if z == nil {
+			z = make(map[string]float64)
+			r.zsets[args[0]] = z
+		}
+		nx := strings.ToUpper(args[1]) == "NX"
+		if nx {
+			args = args[1:]
+		}
+		score, _ := strconv.ParseFloat(args[1], 64)
+		if _, ok := z[args[2]]; ok {
+			if !nx {
+				z[args[2]] = score
+			}
+			return int64(0)
+		}
+		z[args[2]] = score
+		return int64(1)
+	case "ZCARD":
+		return int64(len(r.zsets[args[0]]))
+	case "ZSCORE":
+		if score, ok := r.zsets[args[0]][args[1]]; ok {
+			return strconv.FormatFloat(score, 'f', -1, 64)
+		}
+		return nil
+	case "ZREM":
+		var n int64
+		for _, m := range args[1:] {
+			if _, ok := r.zsets[args[0]][m]; ok {
+				delete(r.zsets[args[0]], m)
+				n++
+			}
+		}
+		return n
+	case "ZRANGE":
+		return r.zrange(args[0], args[1], args[2])
+	case "EVAL":
+		return r.eval(args)
+	}
+
+	return redisError("ERR unknown command " + cmd)
+}
+
+func (r *fakeRedis) zrange(key, start, stop string) interface{} {
+	z := r.zsets[key]
+	members := make([]string, 0, len(z))
+	for m := range z {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+
+	from, _ := strconv.Atoi(start)
+	to, _ := strconv.Atoi(stop)
+	res := []interface{}{}
+	for i := from; i <= to && i < len(members); i++ {
+		res = append(res, members[i])
+	}
+
+	return res
+}
+
+func (r *fakeRedis) eval(args []string) interface{} {
+	numKeys, _ := strconv.Atoi(args[1])
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+
+	switch args[0] {
+	case releaseLeaseScript:
+		if v, ok := r.get(keys[0]); ok && v == argv[0] {
+			return r.del(keys[0])
+		}
+		return int64(0)
+	case renewLeasesScript:
+		var n int64
+		for _, key := range keys {
+			if v, ok := r.get(key); ok && v == argv[0] {
+				n += r.pexpire(key, argv[1])
+			}
+		}
+		return n
+	}
+
+	return redisError("ERR unknown script")
+}
+
+// newTestSharedStore returns store of worker with its own lease owner
+func newTestSharedStore(t *testing.T, r *fakeRedis, owner string, leaseTTL time.Duration) *SharedStore {
+	client, err := NewRedisClient(r.url(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSharedStore(client, "test:", leaseTTL)
+	s.owner = owner
+
+	return s
+}
+
+func mustNext(t *testing.T, f *sharedFrontier) frontierItem {
+	t.Helper()
+
+	item, ok, done := f.next()
+	if !ok || done {
+		t.Fatalf("no item leased: ok %v, done %v", ok, done)
+	}
+
+	return item
+}
+
+func mustNotNext(t *testing.T, f *sharedFrontier, wantDone bool) {
+	t.Helper()
+
+	item, ok, done := f.next()
+	if ok {
+		t.Fatalf("unexpected item leased: %s", item.URL)
+	}
+	if done != wantDone {
+		t.Fatalf("done: %v, expected %v", done, wantDone)
+	}
+}
+
+func TestSharedFrontierLease(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	a := newTestSharedStore(t, r, "a", time.Minute).frontier(OrderBFS)
+	b := newTestSharedStore(t, r, "b", time.Minute).frontier(OrderBFS)
+
+	a.push(frontierItem{URL: "http://example.com/1"})
+	a.push(frontierItem{URL: "http://example.com/2"})
+	a.push(frontierItem{URL: "http://example.com/f.txt", File: true})
+
+	// files go first
+	if item := mustNext(t, a); item.URL != "http://example.com/f.txt" {
+		t.Fatalf("leased %s", item.URL)
+	}
+	item1 := mustNext(t, a)
+	item2 := mustNext(t, b)
+	if item1.URL != "http://example.com/1" || item2.URL != "http://example.com/2" {
+		t.Fatalf("leased %s and %s", item1.URL, item2.URL)
+	}
+
+	// leased items are pending until they are finished
+	mustNotNext(t, b, false)
+	a.finish(frontierItem{URL: "http://example.com/f.txt", File: true}, false)
+	a.finish(item1, false)
+	mustNotNext(t, b, false)
+
+	// interrupted item is given to another worker
+	b.finish(item2, true)
+	if item := mustNext(t, a); item.URL != item2.URL {
+		t.Fatalf("leased %s", item.URL)
+	}
+	a.finish(item2, false)
+
+	mustNotNext(t, a, true)
+	mustNotNext(t, b, true)
+	n, err := a.s.pending()
+	if err != nil || n != 0 {
+		t.Fatalf("pending: %d, %v", n, err)
+	}
+}
+
+func TestSharedFrontierLeaseError(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	a := newTestSharedStore(t, r, "a", time.Minute).frontier(OrderBFS)
+	a.push(frontierItem{URL: "http://example.com/1"})
+
+	r.lock.Lock()
+	r.failing["ZSCORE"] = true
+	r.lock.Unlock()
+
+	member, err := a.lease(a.s.key("pages"))
+	if err == nil || member != "" {
+		t.Fatalf("lease with failing ZSCORE: %q, %v", member, err)
+	}
+
+	r.lock.Lock()
+	delete(r.failing, "ZSCORE")
+	r.lock.Unlock()
+
+	// lease taken before the error is released
+	if item := mustNext(t, a); item.URL != "http://example.com/1" {
+		t.Fatalf("leased %s", item.URL)
+	}
+}
+
+func TestSharedFrontierLeaseExpiry(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	ttl := 100 * time.Millisecond
+	a := newTestSharedStore(t, r, "a", ttl).frontier(OrderBFS)
+	b := newTestSharedStore(t, r, "b", ttl).frontier(OrderBFS)
+
+	a.push(frontierItem{URL: "http://example.com/1"})
+	item := mustNext(t, a)
+	mustNotNext(t, b, false)
+
+	// worker a dies without renewing its lease
+	time.Sleep(2 * ttl)
+	if leased := mustNext(t, b); leased.URL != item.URL {
+		t.Fatalf("leased %s", leased.URL)
+	}
+
+	// slow worker a finishes, it should not release lease of b
+	a.finish(item, true)
+	owner, err := redisString(r.client(t).Do("GET", b.s.leaseKey(b.leases[item.URL])))
+	if err != nil || owner != "b" {
+		t.Fatalf("lease owner: %q, %v", owner, err)
+	}
+
+	b.finish(item, false)
+	mustNotNext(t, a, true)
+}
+
+func TestSharedFrontierRenewLeases(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	ttl := 150 * time.Millisecond
+	a := newTestSharedStore(t, r, "a", ttl).frontier(OrderBFS)
+	b := newTestSharedStore(t, r, "b", ttl).frontier(OrderBFS)
+
+	a.push(frontierItem{URL: "http://example.com/1"})
+	item := mustNext(t, a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.renewLeases(ctx)
+		close(done)
+	}()
+
+	time.Sleep(3 * ttl)
+	mustNotNext(t, b, false)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("renewLeases is not stopped")
+	}
+
+	time.Sleep(2 * ttl)
+	if leased := mustNext(t, b); leased.URL != item.URL {
+		t.Fatalf("leased %s", leased.URL)
+	}
+}
+
+func TestDistributedCrawl(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html><a href="/page">page</a><a href="/a.txt">a</a></html>`)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html><a href="/">root</a><a href="/b.txt">b</a></html>`)
+	})
+	mux.HandleFunc("/a.txt", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "a")
+	})
+	mux.HandleFunc("/b.txt", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "b")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-shared-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	c := NewCoordinator(newTestSharedStore(t, r, "c", time.Minute), stateDir, OrderBFS)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.start(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinks := []*MemorySink{NewMemorySink(), NewMemorySink()}
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		s := newTestSharedStore(t, r, fmt.Sprintf("w%d", i), time.Minute)
+		d := NewDownloader("", stateDir, 2, 10, WithSharedStore(s), WithSink(sink))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.Work(); err != nil {
+				t.Errorf("work: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var names []string
+	for _, sink := range sinks {
+		names = append(names, sink.Names()...)
+	}
+	if len(names) != 2 {
+		t.Fatalf("stored files: %v", names)
+	}
+
+	n, err := c.store.pending()
+	if err != nil || n != 0 {
+		t.Fatalf("pending: %d, %v", n, err)
+	}
+	records, err := redisInt(r.client(t).Do("HLEN", "test:records"))
+	if err != nil || records != 4 {
+		t.Fatalf("records: %d, %v", records, err)
+	}
+}
+
+func TestCoordinatorRefusesOtherBase(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-shared-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	c := NewCoordinator(newTestSharedStore(t, r, "c", time.Minute), stateDir, OrderBFS)
+	u, err := url.Parse("http://a.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.start(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCoordinator(newTestSharedStore(t, r, "c", time.Minute), stateDir, OrderBFS)
+	err = c.Run("http://b.example.com/")
+	if err == nil || !strings.Contains(err.Error(), "unfinished crawl of http://a.example.com/") {
+		t.Fatalf("run of another base: %v", err)
+	}
+
+	base, err := redisString(r.client(t).Do("GET", "test:base"))
+	if err != nil || base != u.String() {
+		t.Fatalf("base: %q, %v", base, err)
+	}
+	n, err := c.store.pending()
+	if err != nil || n != 1 {
+		t.Fatalf("pending: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Sink is a destination for downloaded files.
+// Every file is written through a SinkFile which becomes
+// visible under its final name only after Commit.
+type Sink interface {
+	// Create starts a new file with the given name
+	Create(name string) (SinkFile, error)
+}
+
+// SinkFile is a file being written to a Sink.
+// Exactly one of Commit or Abort must be called.
+type SinkFile interface {
+	io.Writer
+
+	// Commit atomically publishes the file under its final name
+	Commit() error
+
+	// Abort discards everything written so far
+	Abort() error
+}
+
+// ResumableSink keeps partially written files between runs
+// so their download can be continued
+type ResumableSink interface {
+	Sink
+
+	// PartialSize returns size of suspended file, 0 if there is none
+	PartialSize(name string) int64
+
+	// Resume opens suspended file for appending
+	Resume(name string) (SinkFile, error)
+}
+
+// SuspendableFile can be closed keeping written data for Resume
+type SuspendableFile interface {
+	SinkFile
+
+	Suspend() error
+}
+
+// sinkWorkers is sink of distributed crawl,
+// files are stored by workers
+const sinkWorkers = "workers"
+
+// sinkName returns name of s recorded in state, empty for FSSink
+func sinkName(s Sink) string {
+	switch s.(type) {
+	case *FSSink:
+		return ""
+	case *S3Sink:
+		return "s3"
+	case *MemorySink:
+		return "memory"
+	}
+
+	return fmt.Sprintf("%T", s)
+}
+
+// remoteSink sends requests to store files,
+// it uses transport of Downloader (proxy, TLS settings)
+type remoteSink interface {
+	Sink
+
+	useTransport(t http.RoundTripper)
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"os"
+	"path"
+)
+
+// FSSink stores files in a local directory.
+// Files are written to '<name>.tmp' and renamed on commit.
+type FSSink struct {
+	dir string
+}
+
+// NewFSSink returns sink which stores files in dir
+func NewFSSink(dir string) *FSSink {
+	return &FSSink{dir: dir}
+}
+
+// Create opens temporary file for the name
+func (s *FSSink) Create(name string) (SinkFile, error) {
+	fullPath := path.Join(s.dir, name)
+	tmpPath := fullPath + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if os.IsNotExist(err) {
+		// dir is created with the first file, e.g. for a job of serve
+		err = os.MkdirAll(s.dir, 0755)
+		if err == nil {
+			f, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsFile{f: f, fullPath: fullPath, tmpPath: tmpPath}, nil
+}
+
+type fsFile struct {
+	f        *os.File
+	fullPath string
+	tmpPath  string
+}
+
+func (f *fsFile) Write(p []byte) (int, error) {
+	return f.f.Write(p)
+}
+
+func (f *fsFile) Commit() error {
+	err := f.f.Close()
+	if err != nil {
+		cleanTmp(f.tmpPath)
+		return err
+	}
+
+	return os.Rename(f.tmpPath, f.fullPath)
+}
+
+// PartialSize returns size of temporary file kept by Suspend
+func (s *FSSink) PartialSize(name string) int64 {
+	info, err := os.Stat(path.Join(s.dir, name) + ".tmp")
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// Resume opens temporary file for appending
+func (s *FSSink) Resume(name string) (SinkFile, error) {
+	fullPath := path.Join(s.dir, name)
+	tmpPath := fullPath + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsFile{f: f, fullPath: fullPath, tmpPath: tmpPath}, nil
+}
+
+// Suspend closes file keeping temporary file on disk
+func (f *fsFile) Suspend() error {
+	return f.f.Close()
+}
+
+func (f *fsFile) Abort() error {
+	closeC(f.f)
+
+	return os.Remove(f.tmpPath)
+}
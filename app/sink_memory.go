@@ -0,0 +1,73 @@
+package app
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// MemorySink keeps committed files in memory.
+// It's intended for tests.
+type MemorySink struct {
+	files map[string][]byte
+	lock  sync.RWMutex
+}
+
+// NewMemorySink returns empty in-memory sink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{
+		files: make(map[string][]byte, 100),
+	}
+}
+
+// Create starts new in-memory file
+func (s *MemorySink) Create(name string) (SinkFile, error) {
+	return &memoryFile{sink: s, name: name}, nil
+}
+
+// Get returns content of committed file
+func (s *MemorySink) Get(name string) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// Names returns sorted names of committed files
+func (s *MemorySink) Names() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+type memoryFile struct {
+	sink *MemorySink
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *memoryFile) Commit() error {
+	f.sink.lock.Lock()
+	f.sink.files[f.name] = f.buf.Bytes()
+	f.sink.lock.Unlock()
+
+	return nil
+}
+
+func (f *memoryFile) Abort() error {
+	f.buf.Reset()
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3Config describes S3-compatible bucket to store files in
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Sink uploads files to S3-compatible object storage.
+// Files are spooled to a local temporary file and uploaded
+// with a single PUT on commit, so objects never appear half-written.
+type S3Sink struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Sink returns sink which stores files in the bucket
+func NewS3Sink(cfg S3Config) (*S3Sink, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return &S3Sink{
+		cfg:      cfg,
+		endpoint: u,
+		client:   &http.Client{},
+	}, nil
+}
+
+// useTransport makes sink send requests with t,
+// nil means http.DefaultTransport
+func (s *S3Sink) useTransport(t http.RoundTripper) {
+	s.client.Transport = t
+}
+
+// Create starts new object upload
+func (s *S3Sink) Create(name string) (SinkFile, error) {
+	f, err := ioutil.TempFile("", "tegw-s3-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3File{
+		sink: s,
+		key:  path.Join(s.cfg.Prefix, name),
+		f:    f,
+		sum:  sha256.New(),
+	}, nil
+}
+
+type s3File struct {
+	sink *S3Sink
+	key  string
+	f    *os.File
+	sum  hash.Hash
+	size int64
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	f.sum.Write(p[:n])
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *s3File) Commit() error {
+	defer f.cleanup()
+
+	_, err := f.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// the file is closed by cleanup, not by the client
+	return f.sink.put(f.key, ioutil.NopCloser(f.f), f.size, hex.EncodeToString(f.sum.Sum(nil)))
+}
+
+func (f *s3File) Abort() error {
+	f.cleanup()
+
+	return nil
+}
+
+func (f *s3File) cleanup() {
+	closeC(f.f)
+	cleanTmp(f.f.Name())
+}
+
+// objectURL returns url of the object, its path is escaped as
+// AWS expects in signatures, e.g. space is %20 and + is %2B
+func (s *S3Sink) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.cfg.Bucket, key)
+	u.RawPath = awsEscapePath(u.Path)
+
+	return &u
+}
+
+// awsEscapePath escapes every segment of p,
+// only unreserved characters are kept
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		var b strings.Builder
+		for j := 0; j < len(seg); j++ {
+			c := seg[j]
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+				continue
+			}
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+		segments[i] = b.String()
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func (s *S3Sink) put(key string, body io.Reader, size int64, payloadHash string) error {
+	u := s.objectURL(key)
+
+	req, err := http.NewRequest("PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeC(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 put %s: http %d: %s", key, resp.StatusCode, msg)
+	}
+
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (s *S3Sink) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.cfg.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 stores objects put with valid signatures by their raw paths
+type fakeS3 struct {
+	t       *testing.T
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) get(rawPath string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, ok := s.objects[rawPath]
+	return data, ok
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// path as it's sent, it should be the one signed,
+	// proxied requests have absolute uri
+	rawPath := strings.SplitN(r.RequestURI, "?", 2)[0]
+	if i := strings.Index(rawPath, "://"); i >= 0 {
+		rawPath = rawPath[i+3:]
+		rawPath = rawPath[strings.Index(rawPath, "/"):]
+	}
+	if msg := s.checkSignature(r, rawPath, body); msg != "" {
+		s.t.Errorf("PUT %s: %s", rawPath, msg)
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+
+	s.lock.Lock()
+	s.objects[rawPath] = body
+	s.lock.Unlock()
+}
+
+// checkSignature verifies AWS Signature Version 4 of the request
+func (s *fakeS3) checkSignature(r *http.Request, rawPath string, body []byte) string {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return "payload hash mismatch"
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return "invalid x-amz-date " + amzDate
+	}
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+
+	canonicalRequest := "PUT\n" + rawPath + "\n\n" +
+		"host:" + r.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" +
+		payloadHash
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+testSecretKey), amzDate[:8])
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	want := "AWS4-HMAC-SHA256 Credential=" + testAccessKey + "/" + scope +
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" +
+		hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	if got := r.Header.Get("Authorization"); got != want {
+		return "signature mismatch: " + got
+	}
+
+	return ""
+}
+
+func newTestS3Sink(t *testing.T, endpoint, prefix string) *S3Sink {
+	s, err := NewS3Sink(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "bucket",
+		Prefix:    prefix,
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestS3Sink(t *testing.T) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Sink(t, srv.URL, "jobs/1")
+	testSink(t, s, func(name string) ([]byte, bool) {
+		return fake.get("/bucket/jobs/1/" + name)
+	})
+}
+
+func TestS3SinkEscapesKeys(t *testing.T) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Sink(t, srv.URL, "")
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"plain-name_1.txt", "/bucket/plain-name_1.txt"},
+		{"a b.txt", "/bucket/a%20b.txt"},
+		{"a+b=c.txt", "/bucket/a%2Bb%3Dc.txt"},
+		{"a,b;c(1)!.txt", "/bucket/a%2Cb%3Bc%281%29%21.txt"},
+		{"файл~.txt", "/bucket/%D1%84%D0%B0%D0%B9%D0%BB~.txt"},
+	}
+
+	for _, tt := range tests {
+		f, err := s.Create(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write([]byte(tt.name))
+		err = f.Commit()
+		if err != nil {
+			t.Errorf("%s: commit: %v", tt.name, err)
+			continue
+		}
+
+		data, ok := fake.get(tt.path)
+		if !ok || string(data) != tt.name {
+			t.Errorf("%s: object %s: %q, %v", tt.name, tt.path, data, ok)
+		}
+	}
+}
+
+func TestS3SinkUsesDownloaderTransport(t *testing.T) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	// requests go to the fake through the proxy only
+	proxy, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyURL(proxy)}
+
+	s := newTestS3Sink(t, "http://s3.invalid", "")
+	NewDownloader("", "", 1, 10, WithTransport(transport), WithSink(s))
+
+	f, err := s.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("proxied"))
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	data, ok := fake.get("/bucket/a.txt")
+	if !ok || string(data) != "proxied" {
+		t.Fatalf("object: %q, %v", data, ok)
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// testSink checks the Sink contract: files are visible only after
+// Commit, Abort leaves nothing and Create replaces committed file.
+// get returns content of committed file.
+func testSink(t *testing.T, s Sink, get func(name string) ([]byte, bool)) {
+	t.Helper()
+
+	f, err := s.Create("a.txt")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_, err = f.Write([]byte("hello, "))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, err = f.Write([]byte("world"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, ok := get("a.txt"); ok {
+		t.Fatal("file is visible before commit")
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	data, ok := get("a.txt")
+	if !ok || string(data) != "hello, world" {
+		t.Fatalf("committed file: %q, %v", data, ok)
+	}
+
+	f, err = s.Create("b.txt")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_, _ = f.Write([]byte("discarded"))
+	err = f.Abort()
+	if err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if _, ok := get("b.txt"); ok {
+		t.Fatal("aborted file is visible")
+	}
+
+	f, err = s.Create("a.txt")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_, _ = f.Write([]byte("new"))
+	data, _ = get("a.txt")
+	if string(data) != "hello, world" {
+		t.Fatalf("committed file changed before commit: %q", data)
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	data, _ = get("a.txt")
+	if string(data) != "new" {
+		t.Fatalf("replaced file: %q", data)
+	}
+}
+
+func TestFSSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tegw-sink-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the dir is created with the first file
+	outDir := path.Join(dir, "out")
+	testSink(t, NewFSSink(outDir), func(name string) ([]byte, bool) {
+		data, err := ioutil.ReadFile(path.Join(outDir, name))
+		return data, err == nil
+	})
+
+	infos, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "a.txt" {
+		t.Fatalf("temporary files are left: %v", infos)
+	}
+}
+
+func TestFSSinkResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tegw-sink-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewFSSink(dir)
+	f, err := s.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("hello, "))
+	err = f.(SuspendableFile).Suspend()
+	if err != nil {
+		t.Fatalf("suspend: %v", err)
+	}
+	if size := s.PartialSize("a.txt"); size != 7 {
+		t.Fatalf("partial size: %d", size)
+	}
+
+	f, err = s.Resume("a.txt")
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	_, _ = f.Write([]byte("world"))
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "a.txt"))
+	if err != nil || !bytes.Equal(data, []byte("hello, world")) {
+		t.Fatalf("resumed file: %q, %v", data, err)
+	}
+	if size := s.PartialSize("a.txt"); size != 0 {
+		t.Fatalf("partial size after commit: %d", size)
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	s := NewMemorySink()
+	testSink(t, s, s.Get)
+
+	names := s.Names()
+	if len(names) != 1 || names[0] != "a.txt" {
+		t.Fatalf("names: %v", names)
+	}
+}
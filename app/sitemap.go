@@ -0,0 +1,91 @@
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// WithSitemapPriority makes OrderPriority use page priorities
+// from sitemap.xml of the base URL's host
+func WithSitemapPriority() Option {
+	return func(d *Downloader) {
+		d.useSitemap = true
+	}
+}
+
+// defaultSitemapPriority is used for sitemap entries without priority
+const defaultSitemapPriority = 0.5
+
+type sitemapDoc struct {
+	URLs []struct {
+		Loc      string `xml:"loc"`
+		Priority string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// loadSitemap reads priorities from sitemap.xml
+// and sitemaps listed in it if it's a sitemap index
+func (d *Downloader) loadSitemap(ctx context.Context) {
+	d.sitemap = make(map[string]float64, 100)
+
+	u := &url.URL{Scheme: d.baseURL.Scheme, Host: d.baseURL.Host, Path: "/sitemap.xml"}
+
+	doc, err := d.fetchSitemap(ctx, u.String())
+	if err != nil {
+		log.Printf("WARN: failed to load sitemap: %v", err)
+		return
+	}
+
+	docs := []*sitemapDoc{doc}
+	for _, s := range doc.Sitemaps {
+		child, err := d.fetchSitemap(ctx, s.Loc)
+		if err != nil {
+			log.Printf("WARN: failed to load sitemap %s: %v", s.Loc, err)
+			continue
+		}
+		docs = append(docs, child)
+	}
+
+	for _, doc := range docs {
+		for _, entry := range doc.URLs {
+			p := defaultSitemapPriority
+			if entry.Priority != "" {
+				v, err := strconv.ParseFloat(entry.Priority, 64)
+				if err == nil {
+					p = v
+				}
+			}
+			d.sitemap[entry.Loc] = p
+		}
+	}
+
+	log.Printf("loaded %d sitemap priorities", len(d.sitemap))
+}
+
+func (d *Downloader) fetchSitemap(ctx context.Context, link string) (*sitemapDoc, error) {
+	resp, err := d.client.Do(d.buildRequest(ctx, link))
+	if err != nil {
+		return nil, err
+	}
+	defer closeC(resp.Body)
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("http %d", resp.StatusCode)
+	}
+
+	doc := &sitemapDoc{}
+	err = xml.NewDecoder(resp.Body).Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
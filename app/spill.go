@@ -0,0 +1,129 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+// spillStore keeps chunks of queued items on disk
+// when there are too many of them to keep in memory
+type spillStore struct {
+	dir    string
+	prefix string
+	chunks []string // chunk files in order they were written
+	seq    int
+	count  int // number of items in all chunks
+}
+
+func newSpillStore(dir, prefix string) *spillStore {
+	return &spillStore{dir: dir, prefix: prefix}
+}
+
+// write stores chunk of items on disk
+func (s *spillStore) write(items []frontierItem) error {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	name := path.Join(s.dir, fmt.Sprintf("%s-%08d.jsonl", s.prefix, s.seq))
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		err = enc.Encode(item)
+		if err != nil {
+			closeC(f)
+			cleanTmp(name)
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		closeC(f)
+		cleanTmp(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		cleanTmp(name)
+		return err
+	}
+
+	s.chunks = append(s.chunks, name)
+	s.count += len(items)
+
+	return nil
+}
+
+// empty returns true if nothing is stored on disk
+func (s *spillStore) empty() bool {
+	return len(s.chunks) == 0
+}
+
+// readFirst reads and removes the oldest chunk
+func (s *spillStore) readFirst() ([]frontierItem, error) {
+	name := s.chunks[0]
+	s.chunks = s.chunks[1:]
+
+	return s.take(name)
+}
+
+// readLast reads and removes the newest chunk
+func (s *spillStore) readLast() ([]frontierItem, error) {
+	name := s.chunks[len(s.chunks)-1]
+	s.chunks = s.chunks[:len(s.chunks)-1]
+
+	return s.take(name)
+}
+
+func (s *spillStore) take(name string) ([]frontierItem, error) {
+	items, err := readChunk(name)
+	s.count -= len(items)
+	cleanTmp(name)
+
+	return items, err
+}
+
+// chunk returns items of i-th chunk without removing it
+func (s *spillStore) chunk(i int) []frontierItem {
+	items, err := readChunk(s.chunks[i])
+	if err != nil {
+		log.Printf("ERR: failed to read queue chunk: %v", err)
+	}
+
+	return items
+}
+
+func readChunk(name string) ([]frontierItem, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer closeC(f)
+
+	items := make([]frontierItem, 0, 100)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		item := frontierItem{}
+		err = dec.Decode(&item)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
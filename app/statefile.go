@@ -0,0 +1,371 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// kinds of state entries
+const (
+	KindPage = "page"
+	KindFile = "file"
+)
+
+// StateEntry is a page or a file recorded in state
+type StateEntry struct {
+	Kind     string     `json:"kind"`
+	URL      string     `json:"url"`
+	Status   string     `json:"status"`
+	Code     int        `json:"code,omitempty"`
+	Error    string     `json:"error,omitempty"` // why it failed or was skipped
+	Attempts int        `json:"attempts,omitempty"`
+	Added    *time.Time `json:"added,omitempty"`
+	Fetched  *time.Time `json:"fetched,omitempty"`
+	Size     int64      `json:"size,omitempty"`
+	Output   string     `json:"output,omitempty"`
+	SHA256   string     `json:"sha256,omitempty"`
+	Charset  string     `json:"charset,omitempty"`
+}
+
+// StateSummary contains counts of state entries
+type StateSummary struct {
+	Pages    map[string]int `json:"pages"` // status -> count
+	Files    map[string]int `json:"files"`
+	Partials int            `json:"partials"` // files which can be resumed
+	Order    CrawlOrder     `json:"order,omitempty"`
+	Reasons  map[string]int `json:"skip_reasons,omitempty"`
+	Failed   []StateEntry   `json:"failed,omitempty"`
+}
+
+func stateFilePath(stateDir string) string {
+	return path.Join(stateDir, "state.yaml")
+}
+
+// ReadStateEntries returns all entries of the state in stateDir
+// sorted by kind and url
+func ReadStateEntries(stateDir string) ([]StateEntry, error) {
+	s, err := readState(stateFilePath(stateDir))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.entries(stateDir)
+}
+
+// entries returns entries of the state and entries
+// processed with disk seen set from the journal
+func (s *state) entries(stateDir string) ([]StateEntry, error) {
+	res := make([]StateEntry, 0, len(s.URLs)+len(s.Files))
+	for link, r := range s.URLs {
+		res = append(res, entry(KindPage, link, r))
+	}
+	for link, r := range s.Files {
+		res = append(res, entry(KindFile, link, r))
+	}
+
+	journaled := make(map[string]int)
+	err := readJournal(path.Join(stateDir, journalFile), func(e journalEntry) {
+		records := s.URLs
+		if e.Kind == KindFile {
+			records = s.Files
+		}
+		if _, ok := records[e.URL]; ok {
+			return
+		}
+
+		// the latest record wins
+		key := e.Kind + " " + e.URL
+		if i, ok := journaled[key]; ok {
+			res[i] = entry(e.Kind, e.URL, e.Record)
+			return
+		}
+		journaled[key] = len(res)
+		res = append(res, entry(e.Kind, e.URL, e.Record))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// with disk seen set pending items are kept only in the frontier
+	for _, item := range s.Frontier {
+		records := s.URLs
+		if item.File {
+			records = s.Files
+		}
+		key := item.kind() + " " + item.URL
+		if _, ok := records[item.URL]; ok {
+			continue
+		}
+		if _, ok := journaled[key]; ok {
+			continue
+		}
+		journaled[key] = len(res)
+		res = append(res, StateEntry{Kind: item.kind(), URL: item.URL, Status: StatusPending})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind > res[j].Kind // pages first
+		}
+		return res[i].URL < res[j].URL
+	})
+
+	return res, nil
+}
+
+func entry(kind, link string, r *record) StateEntry {
+	return StateEntry{
+		Kind:     kind,
+		URL:      link,
+		Status:   r.Status,
+		Code:     r.Code,
+		Error:    r.Error,
+		Attempts: r.Attempts,
+		Added:    timeOrNil(r.Added),
+		Fetched:  timeOrNil(r.Fetched),
+		Size:     r.Size,
+		Output:   r.Output,
+		SHA256:   r.SHA256,
+		Charset:  r.Charset,
+	}
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// SummarizeState counts entries of the state in stateDir by status
+func SummarizeState(stateDir string) (*StateSummary, error) {
+	s, err := readState(stateFilePath(stateDir))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := s.entries(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := &StateSummary{
+		Pages:   make(map[string]int),
+		Files:   make(map[string]int),
+		Order:   s.Order,
+		Reasons: make(map[string]int),
+	}
+	for _, r := range s.Files {
+		if r.Partial != nil {
+			sum.Partials++
+		}
+	}
+
+	for _, e := range entries {
+		counts := sum.Pages
+		if e.Kind == KindFile {
+			counts = sum.Files
+		}
+		counts[e.Status]++
+
+		switch e.Status {
+		case StatusFailed:
+			sum.Failed = append(sum.Failed, e)
+		case StatusSkipped, StatusFiltered:
+			sum.Reasons[e.Error]++
+		}
+	}
+
+	return sum, nil
+}
+
+// ExportState writes entries of the state in stateDir to w
+// in csv or json format
+func ExportState(stateDir, format string, w io.Writer) error {
+	if format != "csv" && format != "json" {
+		return errors.New("format should be one of: csv, json")
+	}
+
+	entries, err := ReadStateEntries(stateDir)
+	if err != nil {
+		return err
+	}
+
+	return writeEntries(entries, format, w)
+}
+
+// Entries returns entries of the crawl as they are now,
+// unlike the saved state they include progress of running crawl
+func (d *Downloader) Entries() ([]StateEntry, error) {
+	return d.snapshot().entries(d.stateDir)
+}
+
+// writeEntries writes entries to w in csv or json format
+func writeEntries(entries []StateEntry, format string, w io.Writer) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"kind", "url", "status", "code", "error",
+		"attempts", "added", "fetched", "size", "output", "sha256", "charset"})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = cw.Write([]string{e.Kind, e.URL, e.Status, strconv.Itoa(e.Code), e.Error,
+			strconv.Itoa(e.Attempts), formatTime(e.Added), formatTime(e.Fetched),
+			strconv.FormatInt(e.Size, 10), e.Output, e.SHA256, e.Charset})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// ResetState marks entries of the state in stateDir matching pattern
+// as not downloaded, so they are fetched again on the next run.
+// kind is KindPage, KindFile or empty for both.
+// With forget entries are removed from state instead,
+// so they are fetched again only if they are found on pages.
+// Number of reset entries is returned.
+func ResetState(stateDir string, pattern *regexp.Regexp, kind string, forget bool) (int, error) {
+	if kind != "" && kind != KindPage && kind != KindFile {
+		return 0, fmt.Errorf("kind should be one of: %s, %s", KindPage, KindFile)
+	}
+
+	filename := stateFilePath(stateDir)
+	s, err := readState(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	err = backupState(filename, s)
+	if err != nil {
+		return 0, err
+	}
+
+	// with disk seen set processed entries are only in the journal
+	journaled := map[string]map[string]*record{KindPage: {}, KindFile: {}}
+	journalPath := path.Join(stateDir, journalFile)
+	err = readJournal(journalPath, func(e journalEntry) {
+		if records, ok := journaled[e.Kind]; ok {
+			records[e.URL] = e.Record
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n, inJournal := 0, 0
+	if forget {
+		// with disk seen set pending items are kept only in the frontier
+		frontier := s.Frontier[:0]
+		for _, item := range s.Frontier {
+			if kind != "" && kind != item.kind() || !pattern.MatchString(item.URL) {
+				frontier = append(frontier, item)
+				continue
+			}
+			records := s.URLs
+			if item.File {
+				records = s.Files
+			}
+			_, recorded := records[item.URL]
+			_, journaledItem := journaled[item.kind()][item.URL]
+			if !recorded && !journaledItem {
+				n++
+			}
+		}
+		s.Frontier = frontier
+	}
+	if kind != KindFile {
+		n += resetEntries(s.URLs, journaled[KindPage], pattern, forget)
+		inJournal += countMatches(journaled[KindPage], pattern)
+	}
+	if kind != KindPage {
+		n += resetEntries(s.Files, journaled[KindFile], pattern, forget)
+		inJournal += countMatches(journaled[KindFile], pattern)
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	if forget {
+		// forgotten urls are dropped from disk seen set when it's rebuilt
+		err = invalidateSeen(stateDir)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if forget && inJournal > 0 {
+		size, err := filterJournal(journalPath, s.JournalSize, func(e journalEntry) bool {
+			return (kind == "" || kind == e.Kind) && pattern.MatchString(e.URL)
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.JournalSize = &size
+	}
+
+	return n, writeState(filename, s)
+}
+
+// resetEntries resets records matching pattern, journaled records
+// are reset by pending records in m which override them
+func resetEntries(m, journaled map[string]*record, pattern *regexp.Regexp, forget bool) int {
+	matched := make(map[string]*record)
+	for link, r := range journaled {
+		if pattern.MatchString(link) {
+			matched[link] = r
+		}
+	}
+	for link, r := range m {
+		if pattern.MatchString(link) {
+			matched[link] = r
+		}
+	}
+
+	for link, r := range matched {
+		if forget {
+			delete(m, link)
+		} else {
+			// partial file is overwritten by the next download
+			m[link] = &record{Status: StatusPending, Attempts: r.Attempts, Added: r.Added}
+		}
+	}
+
+	return len(matched)
+}
+
+func countMatches(m map[string]*record, pattern *regexp.Regexp) int {
+	n := 0
+	for link := range m {
+		if pattern.MatchString(link) {
+			n++
+		}
+	}
+
+	return n
+}
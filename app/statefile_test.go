@@ -0,0 +1,132 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestResetStateDiskSeen(t *testing.T) {
+	var lock sync.Mutex
+	requested := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requested[req.URL.Path]++
+		lock.Unlock()
+
+		switch req.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><a href="/a">a</a><a href="/data.txt">data</a></html>`)
+		case "/data.txt":
+			fmt.Fprint(w, "data")
+		default:
+			fmt.Fprint(w, `<html></html>`)
+		}
+	}))
+	defer srv.Close()
+
+	stateDir, err := ioutil.TempDir("", "tegw-reset-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	run := func() {
+		t.Helper()
+		d := NewDownloader("", stateDir, 2, 10,
+			WithSink(NewMemorySink()), WithSeenSet(SeenDisk, 1000))
+		err := d.Run(srv.URL + "/")
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	expect := func(want map[string]int) {
+		t.Helper()
+		lock.Lock()
+		defer lock.Unlock()
+		for p, n := range want {
+			if requested[p] != n {
+				t.Errorf("%s requested %d times, expected %d", p, requested[p], n)
+			}
+		}
+	}
+
+	run()
+	expect(map[string]int{"/": 1, "/a": 1, "/data.txt": 1})
+
+	// done entries are only in the journal
+	n, err := ResetState(stateDir, regexp.MustCompile(`data\.txt$`), KindFile, false)
+	if err != nil || n != 1 {
+		t.Fatalf("reset: %d, %v", n, err)
+	}
+	entries, err := ReadStateEntries(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Status != StatusDone && e.URL != srv.URL+"/data.txt" {
+			t.Errorf("%s %s is %s", e.Kind, e.URL, e.Status)
+		}
+		if e.Status != StatusPending && e.URL == srv.URL+"/data.txt" {
+			t.Errorf("reset file is %s", e.Status)
+		}
+	}
+
+	run()
+	expect(map[string]int{"/": 1, "/a": 1, "/data.txt": 2})
+
+	// forgotten page is crawled again as it's found on reset page
+	n, err = ResetState(stateDir, regexp.MustCompile(`/a$`), KindPage, true)
+	if err != nil || n != 1 {
+		t.Fatalf("forget: %d, %v", n, err)
+	}
+	n, err = ResetState(stateDir, regexp.MustCompile(`/$`), KindPage, false)
+	if err != nil || n != 1 {
+		t.Fatalf("reset: %d, %v", n, err)
+	}
+
+	run()
+	expect(map[string]int{"/": 2, "/a": 2, "/data.txt": 2})
+}
+
+func TestForgetFrontierByKind(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "tegw-forget-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	err = writeState(stateFilePath(stateDir), &state{
+		Version: stateVersion,
+		URLs:    map[string]*record{},
+		Files:   map[string]*record{},
+		Frontier: []frontierItem{
+			{URL: "http://example.com/a.txt"},
+			{URL: "http://example.com/b.txt", File: true},
+			{URL: "http://example.com/c"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ResetState(stateDir, regexp.MustCompile(`\.txt$`), KindFile, true)
+	if err != nil || n != 1 {
+		t.Fatalf("forget: %d, %v", n, err)
+	}
+
+	s, err := readState(stateFilePath(stateDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Frontier) != 2 || s.Frontier[0].URL != "http://example.com/a.txt" ||
+		s.Frontier[1].URL != "http://example.com/c" {
+		t.Fatalf("frontier: %+v", s.Frontier)
+	}
+}
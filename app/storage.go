@@ -1,6 +1,7 @@
 package app
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/url"
@@ -11,87 +12,125 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-var errNoState = errors.New("no state fie")
+// ErrNoState is returned if there is no state file in stateDir
+var ErrNoState = errors.New("no state file")
 
 type state struct {
-	URLs  map[string]bool
-	Files map[string]bool
-}
+	Version int `yaml:"version"`
 
-func (d *Downloader) saveState() {
-	f, err := os.OpenFile(d.stateFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("ERR: failed to save state: %v", err)
-		return
-	}
-	defer closeC(f)
+	URLs  map[string]*record
+	Files map[string]*record
 
-	s := &state{
-		URLs:  make(map[string]bool, 100),
-		Files: make(map[string]bool, 100),
-	}
+	// entries of version 1, moved to records on load
+	SkippedURLs  map[string]string      `yaml:"skipped_urls,omitempty"`
+	SkippedFiles map[string]string      `yaml:"skipped_files,omitempty"`
+	Partials     map[string]partialFile `yaml:"partials,omitempty"`
+
+	// pages waiting to be crawled in crawl order
+	Order    CrawlOrder     `yaml:"order,omitempty"`
+	Frontier []frontierItem `yaml:"frontier,omitempty"`
+
+	// size of the journal when state was saved, records appended
+	// after it are dropped if the run was not stopped cleanly
+	JournalSize *int64 `yaml:"journal_size,omitempty"`
+
+	// where files were stored if not in outDir, e.g. s3
+	Sink string `yaml:"sink,omitempty"`
+
+	upgradedFrom int // version of the file if it was upgraded on load
+}
+
+// snapshot copies records and frontier, it can be called while crawling
+func (d *Downloader) snapshot() *state {
+	s := &state{Version: stateVersion}
 
 	d.urlsLock.RLock()
-	for link, downloaded := range d.urls {
-		s.URLs[link] = downloaded
-	}
+	s.URLs = copyRecords(d.urls)
 	d.urlsLock.RUnlock()
 
 	d.filesLock.RLock()
-	for file, downloaded := range d.files {
-		s.Files[file] = downloaded
-	}
+	s.Files = copyRecords(d.files)
 	d.filesLock.RUnlock()
 
-	data, err := yaml.Marshal(s)
-	if err != nil {
-		log.Printf("failed to marhsal state: %+v", err)
-		return
-	}
+	s.Order = d.order
+	s.Sink = sinkName(d.sink)
+	s.Frontier = d.frontier.items()
+	d.keptLock.Lock()
+	s.Frontier = append(s.Frontier, d.kept...)
+	d.keptLock.Unlock()
 
-	_, err = f.Write(data)
-	if err != nil {
-		log.Printf("failed to write state: %+v", err)
-		return
+	return s
+}
+
+func (d *Downloader) saveState() {
+	s := d.snapshot()
+
+	ds, disk := d.seen.(*diskSeenSet)
+	if disk {
+		size, err := d.journal.(*journal).size()
+		if err != nil {
+			log.Printf("ERR: failed to save state: %+v", err)
+			return
+		}
+		s.JournalSize = &size
 	}
 
-	err = f.Sync()
+	err := writeState(d.stateFile, s)
 	if err != nil {
-		log.Printf("failed to sync statefile: %+v", err)
+		log.Printf("ERR: failed to save state: %+v", err)
 		return
 	}
 
+	if disk {
+		ds.setClean(true)
+	}
 }
 
 func (d *Downloader) loadState() error {
-	f, err := os.Open(d.stateFile)
+	s, err := readState(d.stateFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// not loading, just running as is
-			return errNoState
-		}
 		return err
 	}
-	defer closeC(f)
 
-	s := &state{
-		URLs:  make(map[string]bool, 100),
-		Files: make(map[string]bool, 100),
-	}
-
-	data, err := ioutil.ReadAll(f)
+	err = backupState(d.stateFile, s)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(data, s)
-	if err != nil {
-		return err
+	if ds, ok := d.seen.(*diskSeenSet); ok && !ds.clean {
+		err = d.rebuildSeen(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Order != "" && s.Order != d.order {
+		log.Printf("WARN: state was crawled in %s order, continuing in %s order",
+			s.Order, d.order)
 	}
 
-	for link, processed := range s.URLs {
-		if processed {
-			d.urls[link] = processed
+	queued := make(map[string]bool, len(s.Frontier))
+	for _, item := range s.Frontier {
+		queued[item.kind()+" "+item.URL] = true
+	}
+	if d.retryOnly {
+		// saved back unchanged, so the next crawl continues in the same order
+		d.kept = s.Frontier
+	} else {
+		d.restoredItems = s.Frontier
+	}
+
+	for link, r := range s.URLs {
+		d.urls[link] = r
+		if r.finished() {
+			continue
+		}
+
+		if d.seen != nil {
+			// state could be saved with memory seen set
+			d.seen.add("u " + link)
+		}
+		if queued[KindPage+" "+link] || d.retryOnly && r.Status != StatusFailed {
 			continue
 		}
 
@@ -104,9 +143,16 @@ func (d *Downloader) loadState() error {
 		d.restoredURLs = append(d.restoredURLs, u)
 	}
 
-	for link, processed := range s.Files {
-		if processed {
-			d.files[link] = processed
+	for link, r := range s.Files {
+		d.files[link] = r
+		if r.finished() {
+			continue
+		}
+
+		if d.seen != nil {
+			d.seen.add("f " + link)
+		}
+		if queued[KindFile+" "+link] || d.retryOnly && r.Status != StatusFailed {
 			continue
 		}
 
@@ -121,3 +167,95 @@ func (d *Downloader) loadState() error {
 
 	return nil
 }
+
+// readState reads state file, ErrNoState is returned if there is no file
+func readState(filename string) (*state, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// not loading, just running as is
+			return nil, ErrNoState
+		}
+		return nil, err
+	}
+	defer closeC(f)
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// layout of newer versions is unknown, checking version first
+	v := struct {
+		Version int `yaml:"version"`
+	}{}
+	err = yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	if v.Version > stateVersion {
+		return nil, fmt.Errorf("state file version %d is newer than supported version %d, "+
+			"it was saved by a newer version of tegw", v.Version, stateVersion)
+	}
+
+	s := &state{}
+	err = yaml.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.upgrade()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// writeState replaces state file atomically
+func writeState(filename string, s *state) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic replaces file with data, so it's never seen partially written
+func writeFileAtomic(filename string, data []byte) error {
+	tmpPath := filename + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		closeC(f)
+		cleanTmp(tmpPath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		cleanTmp(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filename)
+}
+
+// copyRecords copies records to be saved while they are updated
+func copyRecords(m map[string]*record) map[string]*record {
+	res := make(map[string]*record, len(m))
+	for k, r := range m {
+		c := *r
+		res[k] = &c
+	}
+
+	return res
+}
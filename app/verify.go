@@ -0,0 +1,208 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyReport lists stored files which don't match the state
+type VerifyReport struct {
+	Checked   int          `json:"checked"`  // files compared with their checksums
+	Unhashed  int          `json:"unhashed"` // files without checksum, only their size is compared
+	Missing   []StateEntry `json:"missing,omitempty"`
+	Corrupted []StateEntry `json:"corrupted,omitempty"` // Error tells what is wrong
+	Extra     []string     `json:"extra,omitempty"`     // files in outDir unknown to the state
+	Reset     int          `json:"reset,omitempty"`
+}
+
+// OK returns true if all files match the state
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0 && len(r.Extra) == 0
+}
+
+// VerifyFiles compares files stored in outDir with sizes and checksums
+// recorded in the state in stateDir. With reset missing and corrupted
+// files are marked as pending, so they are fetched on the next run.
+// Files stored in other sinks, e.g. s3, can't be verified.
+func VerifyFiles(stateDir, outDir string, reset bool) (*VerifyReport, error) {
+	filename := stateFilePath(stateDir)
+	s, err := readState(filename)
+	if err != nil {
+		return nil, err
+	}
+	if s.Sink != "" {
+		return nil, fmt.Errorf("files were stored in %s sink, only files in outDir can be verified", s.Sink)
+	}
+
+	files, err := s.fileRecords(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]string, 0, len(files))
+	for link := range files {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+
+	report := &VerifyReport{}
+	known := make(map[string]bool)
+	var bad []string
+	for _, link := range links {
+		r := files[link]
+		if r.Partial != nil {
+			known[r.Partial.Name+".tmp"] = true
+		}
+		if r.Output == "" {
+			continue
+		}
+		known[r.Output] = true
+		known[r.Output+metaExt] = true
+		if r.Status != StatusDone {
+			continue
+		}
+
+		problem, err := verifyFile(path.Join(outDir, r.Output), r)
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, entry(KindFile, link, r))
+			bad = append(bad, link)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if r.SHA256 != "" {
+			report.Checked++
+		} else {
+			report.Unhashed++
+		}
+		if problem != "" {
+			e := entry(KindFile, link, r)
+			e.Error = problem
+			report.Corrupted = append(report.Corrupted, e)
+			bad = append(bad, link)
+		}
+	}
+
+	report.Extra, err = extraFiles(outDir, known, sameDir(stateDir, outDir))
+	if err != nil {
+		return nil, err
+	}
+
+	if !reset || len(bad) == 0 {
+		return report, nil
+	}
+
+	err = backupState(filename, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range bad {
+		r := files[link]
+		// journaled records are overridden by records in the state
+		s.Files[link] = &record{Status: StatusPending, Attempts: r.Attempts,
+			Added: r.Added, Referer: r.Referer}
+	}
+	report.Reset = len(bad)
+
+	return report, writeState(filename, s)
+}
+
+// fileRecords returns records of files in the state
+// and files processed with disk seen set from the journal
+func (s *state) fileRecords(stateDir string) (map[string]*record, error) {
+	files := make(map[string]*record, len(s.Files))
+	for link, r := range s.Files {
+		files[link] = r
+	}
+
+	err := readJournal(path.Join(stateDir, journalFile), func(e journalEntry) {
+		if e.Kind != KindFile {
+			return
+		}
+		if _, ok := s.Files[e.URL]; ok {
+			return
+		}
+		// the latest record wins
+		files[e.URL] = e.Record
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// verifyFile returns what is wrong with stored file of r
+// or empty string if it matches the record
+func verifyFile(filename string, r *record) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer closeC(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != r.Size {
+		return fmt.Sprintf("size mismatch: %d bytes, %d in state", info.Size(), r.Size), nil
+	}
+
+	if r.SHA256 == "" {
+		return "", nil
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != r.SHA256 {
+		return fmt.Sprintf("checksum mismatch: %s, %s in state", sum, r.SHA256), nil
+	}
+
+	return "", nil
+}
+
+// extraFiles returns names of files in outDir which are not known.
+// If state is stored in outDir as well its files are skipped.
+func extraFiles(outDir string, known map[string]bool, withState bool) ([]string, error) {
+	infos, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var extra []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || known[name] {
+			continue
+		}
+		if withState && (strings.HasPrefix(name, "state.yaml") ||
+			name == lockFile || name == journalFile) {
+			continue
+		}
+		extra = append(extra, name)
+	}
+
+	return extra, nil
+}
+
+func sameDir(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+
+	return errA == nil && errB == nil && a == b
+}
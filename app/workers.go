@@ -0,0 +1,66 @@
+package app
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// WithQueueMemory limits number of queued pages and files kept
+// in memory, the rest is spilled to disk in stateDir.
+// Zero means no limit.
+func WithQueueMemory(items int) Option {
+	return func(d *Downloader) {
+		d.queueMemory = items
+	}
+}
+
+// runWorkers downloads pages and files from the frontier
+// with fixed number of workers until there is nothing left
+// or dispatchCtx is cancelled. Downloads are cancelled with ctx.
+func (d *Downloader) runWorkers(dispatchCtx, ctx context.Context) {
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < d.threads; i++ {
+		wg.Add(1)
+		go func() {
+			d.worker(dispatchCtx, ctx)
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (d *Downloader) worker(dispatchCtx, ctx context.Context) {
+	for {
+		// blocks while crawl is paused
+		select {
+		case <-dispatchCtx.Done():
+			return
+		case <-d.runningCh():
+		}
+
+		item, ok, done := d.frontier.next()
+		if !ok {
+			if done {
+				return
+			}
+
+			select {
+			case <-dispatchCtx.Done():
+				return
+			case <-d.frontier.wait():
+			}
+			continue
+		}
+
+		if item.File {
+			d.processNewFile(ctx, item)
+		} else {
+			d.processNewURLV2(ctx, item)
+		}
+
+		d.frontier.finish(item, ctx.Err() != nil)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/scukonick/tegw/app"
+)
+
+const usage = `usage: tegw [command] [flags]
+
+commands:
+  crawl         crawl from baseURL or continue previous crawl (default)
+  retry-failed  fetch again only failed pages and files from state
+  status        summarize state: counts, failures, pending
+  export        dump state entries as csv or json
+  reset         mark entries matching pattern as not downloaded
+  verify        check stored files against sizes and checksums in state
+  coordinate    start distributed crawl in redis and wait for workers
+  worker        crawl pages and files of distributed crawl from redis
+  serve         run crawl jobs submitted with http API
+
+Run 'tegw <command> -h' for command flags.
+`
+
+func main() {
+	cmd, args := "crawl", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "crawl":
+		crawl(args, false)
+	case "retry-failed":
+		crawl(args, true)
+	case "status":
+		status(args)
+	case "export":
+		export(args)
+	case "reset":
+		reset(args)
+	case "verify":
+		verify(args)
+	case "coordinate":
+		coordinate(args)
+	case "worker":
+		work(args)
+	case "serve":
+		serve(args)
+	case "help":
+		fmt.Fprint(os.Stderr, usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		log.Fatalf("unknown command %q", cmd)
+	}
+}
+
+// commandFlags returns flag set of command with -stateDir flag
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dir := fs.String("stateDir", ".", "where state is stored")
+
+	return fs, dir
+}
+
+// status prints summary of the state
+func status(args []string) {
+	fs, dir := commandFlags("status")
+	asJSON := fs.Bool("json", false, "print summary as json")
+	_ = fs.Parse(args)
+
+	sum, err := app.SummarizeState(*dir)
+	if err != nil {
+		log.Fatalf("failed to read state in %s: %v", *dir, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(sum)
+		if err != nil {
+			log.Fatalf("failed to write summary: %v", err)
+		}
+		return
+	}
+
+	printSummary(os.Stdout, sum)
+}
+
+func printSummary(w io.Writer, sum *app.StateSummary) {
+	if sum.Order != "" {
+		fmt.Fprintf(w, "order: %s\n", sum.Order)
+	}
+
+	for _, kind := range []struct {
+		name   string
+		counts map[string]int
+	}{{"pages", sum.Pages}, {"files", sum.Files}} {
+		fmt.Fprintf(w, "%s: %d done, %d pending, %d failed, %d skipped, %d filtered\n", kind.name,
+			kind.counts[app.StatusDone], kind.counts[app.StatusPending],
+			kind.counts[app.StatusFailed], kind.counts[app.StatusSkipped],
+			kind.counts[app.StatusFiltered])
+	}
+	fmt.Fprintf(w, "partial downloads: %d\n", sum.Partials)
+
+	if len(sum.Reasons) > 0 {
+		reasons := make([]string, 0, len(sum.Reasons))
+		for reason := range sum.Reasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+
+		fmt.Fprintln(w, "skipped and filtered:")
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "  %6d %s\n", sum.Reasons[reason], reason)
+		}
+	}
+
+	if len(sum.Failed) > 0 {
+		fmt.Fprintln(w, "failed:")
+		for _, e := range sum.Failed {
+			fmt.Fprintf(w, "  %s %s: %s\n", e.Kind, e.URL, e.Error)
+		}
+	}
+}
+
+// export writes state entries to stdout or file
+func export(args []string) {
+	fs, dir := commandFlags("export")
+	format := fs.String("format", "csv", "output format: csv or json")
+	output := fs.String("output", "", "file to write to instead of stdout")
+	_ = fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("failed to create output: %v", err)
+		}
+		defer func() {
+			err := f.Close()
+			if err != nil {
+				log.Fatalf("failed to write output: %v", err)
+			}
+		}()
+		w = f
+	}
+
+	err := app.ExportState(*dir, *format, w)
+	if err != nil {
+		log.Fatalf("failed to export state in %s: %v", *dir, err)
+	}
+}
+
+// reset marks state entries matching pattern as not downloaded
+func reset(args []string) {
+	fs, dir := commandFlags("reset")
+	pattern := fs.String("pattern", "", "regexp matching urls to reset")
+	kind := fs.String("kind", "", "reset only pages or files: page or file")
+	forget := fs.Bool("forget", false, "remove entries from state instead, "+
+		"they are fetched again only if found on pages")
+	_ = fs.Parse(args)
+
+	if *pattern == "" {
+		log.Fatal("reset: -pattern should be set, use '.' to reset everything")
+	}
+	re, err := regexp.Compile(*pattern)
+	if err != nil {
+		log.Fatalf("reset: invalid pattern: %v", err)
+	}
+
+	lock, err := app.AcquireLock(*dir, 0, false)
+	if err != nil {
+		log.Fatalf("reset: %v", err)
+	}
+	n, err := app.ResetState(*dir, re, *kind, *forget)
+	releaseLock(lock)
+	if err != nil {
+		log.Fatalf("failed to reset state in %s: %v", *dir, err)
+	}
+	log.Printf("%d entries reset", n)
+}
+
+// verify compares files in outDir with state,
+// exits with status 1 if any of them doesn't match
+func verify(args []string) {
+	fs, dir := commandFlags("verify")
+	out := fs.String("outDir", ".", "where downloaded files are stored")
+	resetBad := fs.Bool("reset", false, "mark missing and corrupted files as pending, "+
+		"so they are fetched on the next run")
+	asJSON := fs.Bool("json", false, "print report as json")
+	_ = fs.Parse(args)
+
+	var lock *app.Lock
+	if *resetBad {
+		var err error
+		lock, err = app.AcquireLock(*dir, 0, false)
+		if err != nil {
+			log.Fatalf("verify: %v", err)
+		}
+	}
+	report, err := app.VerifyFiles(*dir, *out, *resetBad)
+	if lock != nil {
+		releaseLock(lock)
+	}
+	if err != nil {
+		log.Fatalf("failed to verify files in %s: %v", *out, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+		if err != nil {
+			log.Fatalf("failed to write report: %v", err)
+		}
+	} else {
+		printReport(os.Stdout, report)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func printReport(w io.Writer, report *app.VerifyReport) {
+	fmt.Fprintf(w, "checked: %d files, %d without checksum\n", report.Checked, report.Unhashed)
+
+	if len(report.Missing) > 0 {
+		fmt.Fprintln(w, "missing:")
+		for _, e := range report.Missing {
+			fmt.Fprintf(w, "  %s %s\n", e.Output, e.URL)
+		}
+	}
+	if len(report.Corrupted) > 0 {
+		fmt.Fprintln(w, "corrupted:")
+		for _, e := range report.Corrupted {
+			fmt.Fprintf(w, "  %s %s: %s\n", e.Output, e.URL, e.Error)
+		}
+	}
+	if len(report.Extra) > 0 {
+		fmt.Fprintln(w, "extra:")
+		for _, name := range report.Extra {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+	if report.Reset > 0 {
+		fmt.Fprintf(w, "%d files reset\n", report.Reset)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/scukonick/tegw/app"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is prefix of environment variables overriding settings,
+// e.g. TEGW_MAX_FILE_SIZE overrides maxFileSize
+const envPrefix = "TEGW_"
+
+// parseSettings parses flags and applies settings from config file
+// and environment. Flags take precedence over environment,
+// environment takes precedence over config file.
+func parseSettings(args []string) error {
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if configFile != "" {
+		err = applyConfigFile(configFile, explicit)
+		if err != nil {
+			return fmt.Errorf("config %s: %v", configFile, err)
+		}
+	}
+
+	err = applyEnv(explicit)
+	if err != nil {
+		return err
+	}
+
+	return validateSettings()
+}
+
+// applyConfigFile sets flags which were not set explicitly
+// from yaml file with flag names as keys.
+// Repeated flags are set with lists.
+func applyConfigFile(filename string, explicit map[string]bool) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := flag.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if explicit[key] {
+			continue
+		}
+
+		list, isList := values[key].([]interface{})
+		if !isList {
+			list = []interface{}{values[key]}
+		}
+		if _, ok := f.Value.(*listFlag); !ok && isList {
+			return fmt.Errorf("setting %q should not be a list", key)
+		}
+
+		for _, v := range list {
+			err = f.Value.Set(fmt.Sprint(v))
+			if err != nil {
+				return fmt.Errorf("invalid value %v for %q: %v", v, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyEnv sets flags which were not set explicitly
+// from environment. Values of repeated flags are separated by newlines.
+func applyEnv(explicit map[string]bool) error {
+	var err error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		values := []string{v}
+		if l, isList := f.Value.(*listFlag); isList {
+			l.reset()
+			values = strings.Split(v, "\n")
+		}
+
+		for _, v := range values {
+			setErr := f.Value.Set(v)
+			if setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, name, setErr)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// envName converts flag name to environment variable:
+// maxIdleConnsPerHost -> TEGW_MAX_IDLE_CONNS_PER_HOST
+func envName(name string) string {
+	runes := []rune(name)
+	res := make([]rune, 0, len(runes)+5)
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				res = append(res, '_')
+			}
+		}
+		res = append(res, unicode.ToUpper(r))
+	}
+
+	return envPrefix + string(res)
+}
+
+// validateSettings checks values of all settings
+func validateSettings() error {
+	if timeout <= 0 {
+		return errors.New("invalid timeout setting: should be positive")
+	}
+	if threads <= 0 {
+		return errors.New("invalid threads setting: should be positive")
+	}
+	if sink != "fs" && sink != "s3" {
+		return errors.New("invalid sink setting: should be fs or s3")
+	}
+	if sink == "s3" && s3Cfg.Bucket == "" {
+		return errors.New("invalid s3Bucket setting: should be set for s3 sink")
+	}
+	if keepAlive < 0 {
+		return errors.New("invalid keepAlive setting: should not be negative")
+	}
+	if transportCfg.MaxIdleConnsPerHost <= 0 {
+		return errors.New("invalid maxIdleConnsPerHost setting: should be positive")
+	}
+	if seenExpected <= 0 {
+		return errors.New("invalid seenExpected setting: should be positive")
+	}
+	if queueMemory < 0 {
+		return errors.New("invalid queueMemory setting: should not be negative")
+	}
+	if maxFileSize < 0 {
+		return errors.New("invalid maxFileSize setting: should not be negative")
+	}
+	if maxPageSize < 0 {
+		return errors.New("invalid maxPageSize setting: should not be negative")
+	}
+	if drainTimeout < 0 {
+		return errors.New("invalid drainTimeout setting: should not be negative")
+	}
+	if maxJobs <= 0 {
+		return errors.New("invalid maxJobs setting: should be positive")
+	}
+	if filterMinSize < 0 {
+		return errors.New("invalid filterMinSize setting: should not be negative")
+	}
+	if filterMaxSize < 0 {
+		return errors.New("invalid filterMaxSize setting: should not be negative")
+	}
+	if filterMaxSize > 0 && filterMinSize > filterMaxSize {
+		return errors.New("invalid filterMinSize setting: should not exceed filterMaxSize")
+	}
+	if renderTimeout < 0 {
+		return errors.New("invalid renderTimeout setting: should not be negative")
+	}
+	if leaseTTL < time.Second {
+		return errors.New("invalid leaseTTL setting: should be at least 1s")
+	}
+
+	checks := []settingCheck{
+		{"compressed", onlyErr(app.ParseCompressedMode(compressed))},
+		{"charset", onlyErr(app.ParseCharsetMode(charset))},
+		{"order", onlyErr(app.ParseCrawlOrder(order))},
+		{"seen", onlyErr(app.ParseSeenMode(seen))},
+	}
+	for _, w := range weights {
+		checks = append(checks, settingCheck{"weight", onlyErr(app.ParsePatternWeight(w))})
+	}
+	for _, a := range auth {
+		_, _, err := app.ParseCredentials(a)
+		checks = append(checks, settingCheck{"auth", err})
+	}
+	for _, h := range headers {
+		_, _, err := app.ParseHeader(h)
+		checks = append(checks, settingCheck{"header", err})
+	}
+	for _, h := range hostHeaders {
+		_, _, _, err := app.ParseHostHeader(h)
+		checks = append(checks, settingCheck{"hostHeader", err})
+	}
+
+	checks = append(checks, settingCheck{"filter", onlyErr(fileFilter())})
+
+	for _, c := range checks {
+		if c.err != nil {
+			return fmt.Errorf("invalid %s setting: %v", c.name, c.err)
+		}
+	}
+
+	transportCfg.KeepAlive = time.Duration(keepAlive) * time.Second
+
+	return nil
+}
+
+// settingCheck is a result of parsing setting value
+type settingCheck struct {
+	name string
+	err  error
+}
+
+func onlyErr(_ interface{}, err error) error {
+	return err
+}
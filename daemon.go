@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/scukonick/tegw/app"
+	"gopkg.in/yaml.v2"
+)
+
+// jobsFile describes jobs for daemon mode:
+//
+//	jobs:
+//	  - name: docs
+//	    baseURL: http://docs.example.com/
+//	    schedule: "@every 6h"
+//	    outDir: /data/docs
+//	    stateDir: /var/lib/tegw/docs
+type jobsFile struct {
+	Jobs []struct {
+		Name     string `yaml:"name"`
+		BaseURL  string `yaml:"baseURL"`
+		Schedule string `yaml:"schedule"`
+		OutDir   string `yaml:"outDir"`
+		StateDir string `yaml:"stateDir"`
+	} `yaml:"jobs"`
+}
+
+// runDaemon re-crawls jobs from daemonJobs file on their schedules.
+// All jobs share the same settings and connections.
+func runDaemon(opts []app.Option) {
+	data, err := ioutil.ReadFile(daemonJobs)
+	if err != nil {
+		log.Fatalf("failed to read jobs: %v", err)
+	}
+
+	jobs := jobsFile{}
+	err = yaml.UnmarshalStrict(data, &jobs)
+	if err != nil {
+		log.Fatalf("invalid jobs file: %v", err)
+	}
+	if len(jobs.Jobs) == 0 {
+		log.Fatal("no jobs in jobs file")
+	}
+
+	dm := app.NewDaemon()
+	names := make(map[string]bool, len(jobs.Jobs))
+	locks := make([]*app.Lock, 0, len(jobs.Jobs))
+
+	for i, job := range jobs.Jobs {
+		if job.Name == "" || names[job.Name] {
+			log.Fatalf("job %d: name should be set and unique", i+1)
+		}
+		names[job.Name] = true
+
+		if job.BaseURL == "" || job.OutDir == "" || job.StateDir == "" {
+			log.Fatalf("job %s: baseURL, outDir and stateDir should be set", job.Name)
+		}
+
+		schedule, err := app.ParseSchedule(job.Schedule)
+		if err != nil {
+			log.Fatalf("job %s: invalid schedule: %v", job.Name, err)
+		}
+
+		locks = append(locks, acquireLock(job.StateDir))
+
+		jobOpts := append(append([]app.Option(nil), opts...), sinkOptions(job.Name)...)
+		d := app.NewDownloader(job.OutDir, job.StateDir, threads, timeout, jobOpts...)
+		dm.AddJob(job.Name, job.BaseURL, schedule, d)
+	}
+
+	handlePauseSignals(dm)
+	handleStopSignals(dm)
+
+	if controlAddr != "" {
+		go func() {
+			err := http.ListenAndServe(controlAddr, dm.ControlHandler())
+			if err != nil {
+				log.Fatalf("control endpoint failed: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("daemon started with %d jobs", len(jobs.Jobs))
+	dm.Run()
+	for _, lock := range locks {
+		releaseLock(lock)
+	}
+	log.Print("daemon stopped")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/scukonick/tegw/app"
+)
+
+// sharedStore connects to shared store of distributed crawl set by flags
+func sharedStore() *app.SharedStore {
+	if redisURL == "" {
+		log.Fatal("redis setting should be set for distributed crawl")
+	}
+
+	client, err := app.NewRedisClient(redisURL, time.Duration(timeout)*time.Second)
+	if err != nil {
+		log.Fatalf("invalid redis setting: %v", err)
+	}
+
+	return app.NewSharedStore(client, redisPrefix, leaseTTL)
+}
+
+// coordinate starts distributed crawl from baseURL and saves
+// records reported by workers to stateDir when it's finished
+func coordinate(args []string) {
+	err := parseSettings(args)
+	if err != nil {
+		log.Fatalf("invalid settings: %v", err)
+	}
+
+	crawlOrder, err := app.ParseCrawlOrder(order)
+	if err != nil {
+		log.Fatalf("invalid order setting: %v", err)
+	}
+
+	lock := acquireLock(stateDir)
+	c := app.NewCoordinator(sharedStore(), stateDir, crawlOrder)
+	handleStopSignals(c)
+
+	err = c.Run(baseURL)
+	releaseLock(lock)
+	if err == app.ErrInterrupted {
+		log.Print("stopped waiting for workers, run again to continue")
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		log.Fatalf("run failed: %+v", err)
+	}
+}
+
+// work crawls pages and files of distributed crawl
+// until there is nothing left
+func work(args []string) {
+	err := parseSettings(args)
+	if err != nil {
+		log.Fatalf("invalid settings: %v", err)
+	}
+
+	opts := append(options(), app.WithSharedStore(sharedStore()))
+	d := app.NewDownloader(outDir, stateDir, threads, timeout, append(opts, sinkOptions("")...)...)
+
+	handlePauseSignals(d)
+
+	if controlAddr != "" {
+		go func() {
+			err := http.ListenAndServe(controlAddr, d.ControlHandler())
+			if err != nil {
+				log.Fatalf("control endpoint failed: %v", err)
+			}
+		}()
+	}
+
+	handleStopSignals(d)
+
+	err = d.Work()
+	if err == app.ErrInterrupted {
+		log.Print("worker stopped, its urls are given to other workers")
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		log.Fatalf("work failed: %+v", err)
+	}
+}
@@ -2,18 +2,88 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/scukonick/tegw/app"
 )
 
+// exit codes, 0 means crawl is complete
+// and 1 means it failed
+const (
+	exitInterrupted = 2   // crawl stopped, state saved
+	exitForced      = 130 // second signal, state not saved
+)
+
 var baseURL string
 var outDir string
 var stateDir string
 var timeout int
 var threads int
+var sink string
+var s3Cfg app.S3Config
+var auth listFlag
+var cookiesFile string
+var userAgent string
+var acceptLanguage string
+var headers listFlag
+var hostHeaders listFlag
+var transportCfg app.TransportConfig
+var keepAlive int
+var maxFileSize int64
+var maxPageSize int64
+var compressed string
+var charset string
+var meta bool
+var metaDir string
+var order string
+var weights listFlag
+var sitemapPriority bool
+var queueMemory int
+var seen string
+var seenExpected int
+var drainTimeout time.Duration
+var controlAddr string
+var daemonJobs string
+var configFile string
+var lockWait time.Duration
+var force bool
+var redisURL string
+var redisPrefix string
+var leaseTTL time.Duration
+var maxJobs int
+var renderCommand string
+var renderTimeout time.Duration
+var filterTypes listFlag
+var filterMinSize int64
+var filterMaxSize int64
+var filterMatch listFlag
+var filterKeywords listFlag
+var filterJSONPaths listFlag
+
+// listFlag is a flag which can be passed several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *listFlag) reset() {
+	*l = nil
+}
 
 func init() {
 	flag.StringVar(&baseURL, "baseURL", "http://google.com", "url to start downloads")
@@ -21,32 +91,322 @@ func init() {
 	flag.StringVar(&stateDir, "stateDir", ".", "where to store state")
 	flag.IntVar(&timeout, "timeout", 10, "timeout for requests in seconds")
 	flag.IntVar(&threads, "threads", 5, "number of concurrent downloads")
+	flag.StringVar(&sink, "sink", "fs", "where to store files: fs (outDir) or s3")
+	flag.StringVar(&s3Cfg.Endpoint, "s3Endpoint", "https://s3.amazonaws.com", "s3-compatible storage endpoint")
+	flag.StringVar(&s3Cfg.Region, "s3Region", "us-east-1", "s3 region")
+	flag.StringVar(&s3Cfg.Bucket, "s3Bucket", "", "s3 bucket to store files in")
+	flag.StringVar(&s3Cfg.Prefix, "s3Prefix", "", "prefix for s3 object keys")
+	flag.StringVar(&s3Cfg.AccessKey, "s3AccessKey", os.Getenv("AWS_ACCESS_KEY_ID"), "s3 access key")
+	flag.StringVar(&s3Cfg.SecretKey, "s3SecretKey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "s3 secret key")
+	flag.Var(&auth, "auth", "credentials for a host, can be repeated: "+
+		"host=basic:user:password, host=bearer:token or host=header:Name:value")
+	flag.StringVar(&cookiesFile, "cookies", "", "Netscape cookies.txt file to pre-load cookies from")
+	flag.StringVar(&userAgent, "userAgent", app.DefaultUserAgent, "User-Agent header")
+	flag.StringVar(&acceptLanguage, "acceptLanguage", "", "Accept-Language header")
+	flag.Var(&headers, "header", "extra request header 'Name: value', can be repeated")
+	flag.Var(&hostHeaders, "hostHeader", "request header for a host 'host=Name: value', can be repeated")
+	flag.StringVar(&transportCfg.Proxy, "proxy", "", "http, https or socks5 proxy URL")
+	flag.StringVar(&transportCfg.CAFile, "caFile", "", "PEM bundle of additional trusted CAs")
+	flag.StringVar(&transportCfg.CertFile, "certFile", "", "PEM client certificate")
+	flag.StringVar(&transportCfg.KeyFile, "keyFile", "", "PEM client certificate key")
+	flag.BoolVar(&transportCfg.InsecureSkipVerify, "insecure", false, "do not verify server certificates")
+	flag.IntVar(&transportCfg.MaxIdleConnsPerHost, "maxIdleConnsPerHost", 10, "max idle connections per host")
+	flag.IntVar(&keepAlive, "keepAlive", 30, "keep-alive period in seconds, 0 disables keep-alive")
+	flag.BoolVar(&transportCfg.DisableHTTP2, "disableHTTP2", false, "use HTTP/1.1 only")
+	flag.Int64Var(&maxFileSize, "maxFileSize", 0, "max size of downloaded file in bytes, 0 - no limit")
+	flag.Int64Var(&maxPageSize, "maxPageSize", 0, "max size of parsed html page in bytes, 0 - no limit")
+	flag.StringVar(&compressed, "compressed", "ignore",
+		"compressed text files (.txt.gz, .csv.bz2, ...): ignore, keep or decompress")
+	flag.StringVar(&charset, "charset", "ignore",
+		"charsets of pages and files: ignore, detect (record in state) or utf8 (also transcode files)")
+	flag.BoolVar(&meta, "meta", false, "write <file>.meta.json with url, referer, headers and checksum next to every file")
+	flag.StringVar(&metaDir, "metaDir", "", "write .meta.json files to this directory instead, implies -meta")
+	flag.StringVar(&order, "order", "bfs", "crawl order: bfs, dfs or priority")
+	flag.Var(&weights, "weight", "priority weight for urls matching regexp 'regexp=weight', can be repeated")
+	flag.BoolVar(&sitemapPriority, "sitemapPriority", false, "use priorities from sitemap.xml")
+	flag.IntVar(&queueMemory, "queueMemory", 10000,
+		"max number of queued urls kept in memory, the rest is stored in stateDir, 0 - no limit")
+	flag.StringVar(&seen, "seen", "memory", "where to remember seen urls: memory or disk (stateDir/seen)")
+	flag.IntVar(&seenExpected, "seenExpected", 10000000, "expected number of urls for disk seen set")
+	flag.DurationVar(&drainTimeout, "drainTimeout", 30*time.Second,
+		"how long to wait for downloads in flight after stop signal")
+	flag.StringVar(&controlAddr, "controlAddr", "",
+		"address for control endpoint with /status, /pause and /resume or job API of serve, e.g. 127.0.0.1:8080")
+	flag.StringVar(&daemonJobs, "daemon", "", "run as daemon re-crawling jobs from this yaml file on schedule")
+	flag.StringVar(&configFile, "config", "", "yaml config file with the same keys as flags")
+	flag.DurationVar(&lockWait, "lockWait", 0,
+		"how long to wait for stateDir used by another process, 0 - fail immediately")
+	flag.BoolVar(&force, "force", false, "take over stateDir lock held by another process")
+	flag.StringVar(&redisURL, "redis", "", "redis://[:password@]host[:port][/db] of shared store "+
+		"for coordinate and worker commands")
+	flag.StringVar(&redisPrefix, "redisPrefix", "tegw:", "prefix of keys in shared store, one per crawl")
+	flag.DurationVar(&leaseTTL, "leaseTTL", time.Minute,
+		"how long url is leased by worker before it's given to another one if worker is dead")
+	flag.IntVar(&maxJobs, "maxJobs", 2, "number of jobs run at once by serve")
+	flag.StringVar(&renderCommand, "render", "", "headless browser command printing rendered html "+
+		"of page to extract links from, {file} is replaced with file with fetched html, "+
+		"{url} with page url which is fetched again by browser, "+
+		"e.g. 'chromium --headless --disable-gpu --dump-dom file://{file}'")
+	flag.DurationVar(&renderTimeout, "renderTimeout", 30*time.Second, "how long page can be rendered")
+	flag.Var(&filterTypes, "filterType", "store only files of media type, e.g. text/csv or text/*, can be repeated")
+	flag.Int64Var(&filterMinSize, "filterMinSize", 0, "store only files of at least this size in bytes")
+	flag.Int64Var(&filterMaxSize, "filterMaxSize", 0, "store only files of at most this size in bytes, 0 - no limit")
+	flag.Var(&filterMatch, "filterMatch", "store only files with content matching regexp, can be repeated")
+	flag.Var(&filterKeywords, "filterKeyword", "store only files containing keyword, can be repeated")
+	flag.Var(&filterJSONPaths, "filterJSONPath", "store only json files with value at path, "+
+		"e.g. $.data.items[*].id, can be repeated")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr, "\ncrawl, retry-failed, coordinate, worker and serve flags:")
+		flag.PrintDefaults()
+	}
+}
 
-	flag.Parse()
+// crawl runs crawl with settings from args.
+// With retry only failed pages and files are fetched again.
+func crawl(args []string, retry bool) {
+	err := parseSettings(args)
+	if err != nil {
+		log.Fatalf("invalid settings: %v", err)
+	}
 
-	if timeout <= 0 {
-		log.Fatal("invalid timeout setting")
+	opts := options()
+	if retry {
+		opts = append(opts, app.WithRetryFailed())
 	}
-	if threads <= 0 {
-		log.Fatal("invalid value setting")
+
+	if daemonJobs != "" {
+		if retry {
+			log.Fatal("retry-failed can't be used in daemon mode")
+		}
+		runDaemon(opts)
+		return
 	}
-}
 
-func main() {
-	d := app.NewDownloader(outDir, stateDir, threads, timeout)
+	lock := acquireLock(stateDir)
 
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+	d := app.NewDownloader(outDir, stateDir, threads, timeout, append(opts, sinkOptions("")...)...)
 
-		<-c
-		log.Println("Received stop signal, exiting...")
-		d.Stop()
-	}()
+	handlePauseSignals(d)
+
+	if controlAddr != "" {
+		go func() {
+			err := http.ListenAndServe(controlAddr, d.ControlHandler())
+			if err != nil {
+				log.Fatalf("control endpoint failed: %v", err)
+			}
+		}()
+	}
 
-	err := d.Run(baseURL)
+	handleStopSignals(d)
+
+	err = d.Run(baseURL)
+	releaseLock(lock)
+	if err == app.ErrNoState {
+		log.Fatalf("no state to retry in %s", stateDir)
+	}
+	if err == app.ErrInterrupted {
+		log.Print("crawl interrupted, run again to continue")
+		os.Exit(exitInterrupted)
+	}
 	if err != nil {
 		log.Fatalf("run failed: %+v", err)
 	}
+}
+
+// options builds Downloader options from flags except sink
+func options() []app.Option {
+	opts := make([]app.Option, 0, 16)
+
+	transport, err := app.NewTransport(transportCfg)
+	if err != nil {
+		log.Fatalf("invalid transport settings: %v", err)
+	}
+	opts = append(opts, app.WithTransport(transport))
+	opts = append(opts, app.WithQueueMemory(queueMemory))
+
+	seenMode, err := app.ParseSeenMode(seen)
+	if err != nil {
+		log.Fatalf("invalid seen setting: %v", err)
+	}
+	opts = append(opts, app.WithSeenSet(seenMode, seenExpected))
+	opts = append(opts, app.WithMaxFileSize(maxFileSize), app.WithMaxPageSize(maxPageSize))
+
+	compressedMode, err := app.ParseCompressedMode(compressed)
+	if err != nil {
+		log.Fatalf("invalid compressed setting: %v", err)
+	}
+	opts = append(opts, app.WithCompressed(compressedMode))
+
+	charsetMode, err := app.ParseCharsetMode(charset)
+	if err != nil {
+		log.Fatalf("invalid charset setting: %v", err)
+	}
+	opts = append(opts, app.WithCharset(charsetMode))
+	if meta || metaDir != "" {
+		opts = append(opts, app.WithMeta(metaDir))
+	}
+
+	crawlOrder, err := app.ParseCrawlOrder(order)
+	if err != nil {
+		log.Fatalf("invalid order setting: %v", err)
+	}
+	opts = append(opts, app.WithCrawlOrder(crawlOrder))
+
+	patternWeights := make([]app.PatternWeight, 0, len(weights))
+	for _, w := range weights {
+		pw, err := app.ParsePatternWeight(w)
+		if err != nil {
+			log.Fatalf("invalid weight setting: %v", err)
+		}
+		patternWeights = append(patternWeights, pw)
+	}
+	opts = append(opts, app.WithPatternWeights(patternWeights))
+	if sitemapPriority {
+		opts = append(opts, app.WithSitemapPriority())
+	}
+
+	credentials := make(map[string]app.Credentials, len(auth))
+	for _, spec := range auth {
+		host, c, err := app.ParseCredentials(spec)
+		if err != nil {
+			log.Fatalf("invalid auth setting: %v", err)
+		}
+		credentials[host] = app.MergeCredentials(credentials[host], c)
+	}
+	for host, c := range credentials {
+		opts = append(opts, app.WithCredentials(host, c))
+	}
+
+	opts = append(opts, app.WithUserAgent(userAgent))
+	if acceptLanguage != "" {
+		opts = append(opts, app.WithAcceptLanguage(acceptLanguage))
+	}
+	for _, h := range headers {
+		name, value, err := app.ParseHeader(h)
+		if err != nil {
+			log.Fatalf("invalid header setting: %v", err)
+		}
+		opts = append(opts, app.WithHeader(name, value))
+	}
+	for _, h := range hostHeaders {
+		host, name, value, err := app.ParseHostHeader(h)
+		if err != nil {
+			log.Fatalf("invalid hostHeader setting: %v", err)
+		}
+		opts = append(opts, app.WithHostHeader(host, name, value))
+	}
+
+	filter, err := fileFilter()
+	if err != nil {
+		log.Fatalf("invalid filter settings: %v", err)
+	}
+	opts = append(opts, app.WithFileFilter(filter))
+
+	if renderCommand != "" {
+		r, err := app.NewExecRenderer(renderCommand, renderTimeout)
+		if err != nil {
+			log.Fatalf("invalid render setting: %v", err)
+		}
+		opts = append(opts, app.WithRenderer(r))
+	}
+
+	jar, err := app.LoadCookieJar(cookiesFile)
+	if err != nil {
+		log.Fatalf("failed to load cookies: %v", err)
+	}
+	opts = append(opts, app.WithCookieJar(jar))
+
+	return opts
+}
+
+// fileFilter builds filter of stored files from flags
+func fileFilter() (app.FileFilter, error) {
+	f := app.FileFilter{MinSize: filterMinSize, MaxSize: filterMaxSize}
+
+	for _, t := range filterTypes {
+		mediaType, err := app.ParseMediaRange(t)
+		if err != nil {
+			return f, err
+		}
+		f.Types = append(f.Types, mediaType)
+	}
+	for _, m := range filterMatch {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			return f, fmt.Errorf("invalid filterMatch regexp: %v", err)
+		}
+		f.Match = append(f.Match, re)
+	}
+	for _, k := range filterKeywords {
+		f.Match = append(f.Match, regexp.MustCompile(regexp.QuoteMeta(k)))
+	}
+	for _, p := range filterJSONPaths {
+		jp, err := app.ParseJSONPath(p)
+		if err != nil {
+			return f, err
+		}
+		f.JSONPaths = append(f.JSONPaths, jp)
+	}
 
+	return f, nil
+}
+
+// sinkOptions returns sink set by flags,
+// s3 objects are stored under additional prefix
+func sinkOptions(prefix string) []app.Option {
+	if sink != "s3" {
+		return nil
+	}
+
+	cfg := s3Cfg
+	cfg.Prefix = path.Join(cfg.Prefix, prefix)
+
+	s, err := app.NewS3Sink(cfg)
+	if err != nil {
+		log.Fatalf("failed to init s3 sink: %v", err)
+	}
+
+	return []app.Option{app.WithSink(s)}
+}
+
+// acquireLock locks stateDir or exits if it's used by another process
+func acquireLock(dir string) *app.Lock {
+	lock, err := app.AcquireLock(dir, lockWait, force)
+	if err != nil {
+		log.Fatalf("failed to lock %s: %v", dir, err)
+	}
+
+	return lock
+}
+
+func releaseLock(lock *app.Lock) {
+	err := lock.Release()
+	if err != nil {
+		log.Printf("ERR: failed to release lock: %v", err)
+	}
+}
+
+// pauser is a crawl which can be paused
+type pauser interface {
+	Pause()
+	Resume()
+}
+
+// handleStopSignals shuts crawl down on SIGINT or SIGTERM
+// and exits immediately on second signal
+func handleStopSignals(s interface{ Shutdown(time.Duration) }) {
+	go func() {
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+		sig := <-c
+		log.Printf("Received %v, finishing downloads in flight for up to %v...", sig, drainTimeout)
+		s.Shutdown(drainTimeout)
+
+		<-c
+		log.Println("Received second stop signal, exiting without saving state")
+		os.Exit(exitForced)
+	}()
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/scukonick/tegw/app"
+)
+
+// serve runs jobs submitted with http API on controlAddr.
+// Every job is stored in its own subdirectory of stateDir and outDir.
+func serve(args []string) {
+	err := parseSettings(args)
+	if err != nil {
+		log.Fatalf("invalid settings: %v", err)
+	}
+	if controlAddr == "" {
+		log.Fatal("controlAddr setting should be set for serve")
+	}
+
+	// settings are checked before serving,
+	// every job gets its own transport and cookie jar
+	options()
+	lock := acquireLock(stateDir)
+
+	s, err := app.NewServer(stateDir, outDir, threads, timeout, maxJobs, func(id string) []app.Option {
+		return append(options(), sinkOptions(id)...)
+	})
+	if err != nil {
+		log.Fatalf("failed to load jobs: %v", err)
+	}
+
+	handleStopSignals(s)
+
+	go func() {
+		err := http.ListenAndServe(controlAddr, s.Handler())
+		if err != nil {
+			log.Fatalf("job API failed: %v", err)
+		}
+	}()
+
+	log.Printf("serving job API on %s", controlAddr)
+	s.Run()
+	releaseLock(lock)
+	log.Print("server stopped")
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses crawl on SIGUSR1 and resumes it on SIGUSR2
+func handlePauseSignals(d pauser) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range c {
+			if sig == syscall.SIGUSR1 {
+				d.Pause()
+			} else {
+				d.Resume()
+			}
+		}
+	}()
+}
@@ -0,0 +1,5 @@
+package main
+
+// handlePauseSignals does nothing as there are no SIGUSR1/SIGUSR2 on windows,
+// use control endpoint instead
+func handlePauseSignals(d pauser) {}